@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/fmotalleb/go-tools/log"
 	"github.com/pelletier/go-toml"
 	"gopkg.in/yaml.v3"
 
 	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/router"
 )
 
 // marshalData serializes the given data into the specified format.
@@ -50,14 +52,25 @@ func dumpConf(cfg *config.Config, form ...string) error {
 	return nil
 }
 
+// buildAppContext returns the root context of the application, canceled on SIGINT or SIGTERM.
+// Once canceled, open relays are given drainTimeout to finish before being closed forcibly,
+// the returned cancel function waits for them. A second signal kills the process immediately.
 func buildAppContext() (context.Context, context.CancelFunc, error) {
-	ctx, cancel := signal.NotifyContext(
+	ctx, stop := signal.NotifyContext(
 		context.Background(),
-		os.Kill,
+		os.Interrupt,
+		syscall.SIGTERM,
 	)
+	context.AfterFunc(ctx, stop)
 	ctx, err := log.WithNewEnvLogger(ctx)
 	if err != nil {
+		stop()
 		return nil, nil, err
 	}
+	ctx, wait := router.WithDrain(ctx, drainTimeout)
+	cancel := func() {
+		stop()
+		wait()
+	}
 	return ctx, cancel, nil
 }
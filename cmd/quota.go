@@ -0,0 +1,91 @@
+/*
+Copyright © 2025 Motalleb Fallahnezhad (fmotalleb@gmail.com)
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/fmotalleb/junction/quota"
+)
+
+// quotaCmd represents the quota command.
+var quotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "Report or reset traffic quota usage stored in the quota store file",
+}
+
+var quotaReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Print usage of every quota",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		store, err := openQuotaStore(cmd)
+		if err != nil {
+			return err
+		}
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+		usage := store.Snapshot()
+		if format == "json" {
+			result, err := json.MarshalIndent(usage, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to encode JSON: %w", err)
+			}
+			fmt.Println(string(result))
+			return nil
+		}
+
+		names := make([]string, 0, len(usage))
+		for name := range usage {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "QUOTA\tPERIOD\tBYTES\tUPDATED")
+		for _, name := range names {
+			u := usage[name]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", name, u.Period, u.Bytes, u.Updated.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+var quotaResetCmd = &cobra.Command{
+	Use:   "reset [quota names...]",
+	Short: "Reset usage of the given quotas (all quotas if none is given)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openQuotaStore(cmd)
+		if err != nil {
+			return err
+		}
+		return store.Reset(args...)
+	},
+}
+
+func openQuotaStore(cmd *cobra.Command) (*quota.Store, error) {
+	path, err := cmd.Flags().GetString("store")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errors.New("quota store path is required (same as core.quota_store)")
+	}
+	return quota.Open(path)
+}
+
+func init() {
+	rootCmd.AddCommand(quotaCmd)
+	quotaCmd.AddCommand(quotaReportCmd, quotaResetCmd)
+	quotaCmd.PersistentFlags().StringP("store", "s", "", "quota store file (same as core.quota_store)")
+	quotaReportCmd.Flags().StringP("format", "f", "table", "Format of output (table, json)")
+}
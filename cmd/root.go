@@ -19,21 +19,25 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"os"
 	"time"
 
+	"github.com/fmotalleb/go-tools/env"
 	"github.com/fmotalleb/go-tools/git"
 	"github.com/fmotalleb/go-tools/log"
 	"github.com/fmotalleb/go-tools/reloader"
 	"github.com/spf13/cobra"
 
 	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/quota"
 	"github.com/fmotalleb/junction/server"
 )
 
 var (
-	dump  = false
-	debug = false
+	dump         = false
+	debug        = false
+	drainTimeout = time.Second * 30
 )
 
 // rootCmd represents the base command when called without any subcommands.
@@ -64,6 +68,8 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		// Flush quota usage once open connections are drained
+		defer quota.Close(ctx)
 		defer cancel()
 		err = reloader.WithOsSignal(
 			ctx,
@@ -81,6 +87,10 @@ var rootCmd = &cobra.Command{
 			},
 			time.Minute,
 		)
+		if errors.Is(err, context.Canceled) {
+			// Shutdown requested by signal
+			return nil
+		}
 		return err
 	},
 }
@@ -100,4 +110,5 @@ func init() {
 	rootCmd.Flags().StringP("format", "f", "", "config format (yaml, json, toml, ini, hcl)")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "enable debug mode")
 	rootCmd.PersistentFlags().BoolVar(&dump, "dry-run", false, "just output the config, do not start service")
+	rootCmd.PersistentFlags().DurationVar(&drainTimeout, "drain-timeout", env.DurationOr("DRAIN_TIMEOUT", drainTimeout), "time given to open connections to finish after receiving SIGINT/SIGTERM")
 }
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+
+	"github.com/fmotalleb/go-tools/decoder"
+	"github.com/fmotalleb/go-tools/matcher"
+	"github.com/yl2chen/cidranger"
+)
+
+const cidrMatcherPrefix = "cidr:"
+
+// AddrMatcher matches client addresses, either by network prefix (`cidr:10.0.0.0/8` or plain `10.0.0.0/8`)
+// or by the matcher syntax used in allow_list (glob/regexp on the client ip).
+type AddrMatcher struct {
+	Prefix  *netip.Prefix
+	Pattern *matcher.Matcher
+	raw     string
+}
+
+func (a *AddrMatcher) Decode(from reflect.Type, val interface{}) (any, error) {
+	if from.Kind() != reflect.String {
+		return val, nil
+	}
+	raw, ok := val.(string)
+	if !ok {
+		return val, errors.New("expected string value for address matcher")
+	}
+	raw = strings.TrimSpace(raw)
+	a.raw = raw
+
+	if cidr, ok := strings.CutPrefix(raw, cidrMatcherPrefix); ok {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr matcher %q: %w", raw, err)
+		}
+		a.Prefix = &prefix
+		return a, nil
+	}
+	if prefix, err := netip.ParsePrefix(raw); err == nil {
+		prefix = prefix.Masked()
+		a.Prefix = &prefix
+		return a, nil
+	}
+
+	a.Pattern = new(matcher.Matcher)
+	d, err := decoder.Build(a.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("create decoder: %w", err)
+	}
+	if err = d.Decode(raw); err != nil {
+		return nil, fmt.Errorf("invalid address matcher %q: %w", raw, err)
+	}
+	return a, nil
+}
+
+// MarshalText returns the matcher as written in the config.
+func (a *AddrMatcher) MarshalText() ([]byte, error) {
+	return []byte(a.raw), nil
+}
+
+// parsePrefix accepts both CIDR notation and single addresses.
+func parsePrefix(raw string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(raw); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// addrSet matches prefixes using a prefix trie and falls back to patterns for the rest.
+type addrSet struct {
+	ranger   cidranger.Ranger
+	patterns []*matcher.Matcher
+	size     int
+}
+
+func newAddrSet(matchers []*AddrMatcher) (*addrSet, error) {
+	s := &addrSet{
+		ranger: cidranger.NewPCTrieRanger(),
+		size:   len(matchers),
+	}
+	for _, m := range matchers {
+		switch {
+		case m == nil:
+		case m.Prefix != nil:
+			addr := m.Prefix.Addr()
+			network := net.IPNet{
+				IP:   addr.AsSlice(),
+				Mask: net.CIDRMask(m.Prefix.Bits(), addr.BitLen()),
+			}
+			if err := s.ranger.Insert(cidranger.NewBasicRangerEntry(network)); err != nil {
+				return nil, err
+			}
+		case m.Pattern != nil:
+			s.patterns = append(s.patterns, m.Pattern)
+		}
+	}
+	return s, nil
+}
+
+func (s *addrSet) empty() bool {
+	return s.size == 0
+}
+
+func (s *addrSet) match(ip net.IP, from string) bool {
+	if ip != nil {
+		if ok, err := s.ranger.Contains(ip); err == nil && ok {
+			return true
+		}
+	}
+	for _, p := range s.patterns {
+		if p.Match(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientACL holds the compiled allow_from/block_from lists of an entrypoint.
+type clientACL struct {
+	allow *addrSet
+	block *addrSet
+}
+
+func newClientACL(allow, block []*AddrMatcher) (*clientACL, error) {
+	a, err := newAddrSet(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow_from: %w", err)
+	}
+	b, err := newAddrSet(block)
+	if err != nil {
+		return nil, fmt.Errorf("block_from: %w", err)
+	}
+	return &clientACL{allow: a, block: b}, nil
+}
+
+func (acl *clientACL) allowed(addr net.Addr) bool {
+	if addr == nil {
+		return acl.allow.empty()
+	}
+
+	raw := addr.String()
+	from := raw
+	if host, _, err := net.SplitHostPort(raw); err == nil && host != "" {
+		from = host
+	}
+	ip := net.ParseIP(from)
+	if ip4 := ip.To4(); ip4 != nil {
+		// Treat IPv4-mapped IPv6 clients (dual stack listeners) as IPv4
+		ip = ip4
+	}
+
+	if !acl.block.empty() && acl.block.match(ip, from) {
+		return false
+	}
+	if !acl.allow.empty() {
+		return acl.allow.match(ip, from)
+	}
+	return true
+}
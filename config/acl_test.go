@@ -0,0 +1,99 @@
+package config_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func addrMatchers(t *testing.T, raw ...string) []*config.AddrMatcher {
+	t.Helper()
+	result := make([]*config.AddrMatcher, len(raw))
+	for i, r := range raw {
+		m := new(config.AddrMatcher)
+		_, err := m.Decode(reflect.TypeOf(r), r)
+		assert.NoError(t, err)
+		result[i] = m
+	}
+	return result
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4321}
+}
+
+func TestAllowedFromCIDR(t *testing.T) {
+	entry := config.EntryPoint{
+		AllowFrom: addrMatchers(t, "10.0.0.0/8", "cidr:192.168.1.16/28", "cidr:2001:db8::/32"),
+		BlockFrom: addrMatchers(t, "cidr:10.1.2.3"),
+	}
+	assert.NoError(t, entry.BuildACL())
+
+	tests := map[string]bool{
+		"10.200.0.1":       true,
+		"10.1.2.3":         false,
+		"192.168.1.17":     true,
+		"192.168.1.32":     false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"::ffff:10.0.0.12": true,
+	}
+	for ip, want := range tests {
+		assert.Equal(t, want, entry.AllowedFrom(tcpAddr(ip)), ip)
+	}
+}
+
+func TestAddrMatcherInvalidCIDR(t *testing.T) {
+	m := new(config.AddrMatcher)
+	_, err := m.Decode(reflect.TypeOf(""), "cidr:10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestDestinationAllowedDefaults(t *testing.T) {
+	entry := config.EntryPoint{
+		BlockTo: addrMatchers(t, "203.0.113.0/24"),
+	}
+	assert.NoError(t, entry.BuildACL())
+
+	tests := map[string]bool{
+		"93.184.216.34":   true,
+		"203.0.113.7":     false,
+		"192.168.1.1":     false,
+		"172.16.0.1":      false,
+		"172.32.0.1":      true,
+		"10.1.1.1":        false,
+		"fd00::1":         false,
+		"127.0.0.1":       false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fe80::1":         false,
+	}
+	for ip, want := range tests {
+		assert.Equal(t, want, entry.DestinationAllowed(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestDestinationAllowList(t *testing.T) {
+	entry := config.EntryPoint{
+		AllowTo: addrMatchers(t, "cidr:127.0.0.53", "192.168.0.0/16"),
+	}
+	assert.NoError(t, entry.BuildACL())
+
+	assert.True(t, entry.DestinationAllowed(net.ParseIP("127.0.0.53")))
+	assert.True(t, entry.DestinationAllowed(net.ParseIP("192.168.1.1")))
+	assert.False(t, entry.DestinationAllowed(net.ParseIP("127.0.0.1")))
+	assert.False(t, entry.DestinationAllowed(net.ParseIP("93.184.216.34")))
+}
+
+func TestPurgeAllowed(t *testing.T) {
+	entry := config.EntryPoint{Cache: &config.Cache{PurgeFrom: addrMatchers(t, "127.0.0.0/8")}}
+	assert.NoError(t, entry.BuildACL())
+
+	assert.True(t, entry.Cache.PurgeAllowed(tcpAddr("127.0.0.1")))
+	assert.False(t, entry.Cache.PurgeAllowed(tcpAddr("192.0.2.1")))
+	assert.False(t, (&config.Cache{}).PurgeAllowed(tcpAddr("127.0.0.1")))
+}
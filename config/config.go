@@ -3,6 +3,7 @@ package config
 import (
 	"cmp"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"net/url"
@@ -21,7 +22,8 @@ type Config struct {
 }
 
 type CoreCfg struct {
-	FakeDNS *FakeDNS `mapstructure:"fake_dns" toml:"fake_dns,omitempty" yaml:"fake_dns,omitempty" json:"fake_dns,omitempty"`
+	FakeDNS    *FakeDNS `mapstructure:"fake_dns" toml:"fake_dns,omitempty" yaml:"fake_dns,omitempty" json:"fake_dns,omitempty"`
+	QuotaStore string   `mapstructure:"quota_store" toml:"quota_store,omitempty" yaml:"quota_store,omitempty" json:"quota_store,omitempty"`
 }
 
 type EntryPoint struct {
@@ -29,17 +31,73 @@ type EntryPoint struct {
 	Listen    netip.AddrPort     `mapstructure:"listen,omitempty" toml:"listen,omitempty" yaml:"listen,omitempty" json:"listen,omitempty"`
 	BlockList []*matcher.Matcher `mapstructure:"block_list,omitempty" toml:"block_list,omitempty" yaml:"block_list,omitempty" json:"block_list,omitempty"`
 	AllowList []*matcher.Matcher `mapstructure:"allow_list,omitempty" toml:"allow_list,omitempty" yaml:"allow_list,omitempty" json:"allow_list,omitempty"`
-	AllowFrom []*matcher.Matcher `mapstructure:"allow_from,omitempty" toml:"allow_from,omitempty" yaml:"allow_from,omitempty" json:"allow_from,omitempty"`
-	BlockFrom []*matcher.Matcher `mapstructure:"block_from,omitempty" toml:"block_from,omitempty" yaml:"block_from,omitempty" json:"block_from,omitempty"`
-	Proxy     []*url.URL         `mapstructure:"proxy,omitempty" toml:"proxy,omitempty" yaml:"proxy,omitempty" json:"proxy,omitempty"`
-	Target    string             `mapstructure:"to,omitempty" toml:"to,omitempty" yaml:"to,omitempty" json:"to,omitempty"`
-	Timeout   time.Duration      `mapstructure:"timeout,omitempty" toml:"timeout,omitempty" yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	AllowFrom []*AddrMatcher     `mapstructure:"allow_from,omitempty" toml:"allow_from,omitempty" yaml:"allow_from,omitempty" json:"allow_from,omitempty"`
+	BlockFrom []*AddrMatcher     `mapstructure:"block_from,omitempty" toml:"block_from,omitempty" yaml:"block_from,omitempty" json:"block_from,omitempty"`
+	// ALPN protocols offered by the client (sni only), see AllowedALPN
+	ALPN []*matcher.Matcher `mapstructure:"alpn,omitempty" toml:"alpn,omitempty" yaml:"alpn,omitempty" json:"alpn,omitempty"`
+	// JA3/JA4 client fingerprints (sni only), see AllowedFingerprint
+	AllowFingerprint []*matcher.Matcher `mapstructure:"allow_fingerprint,omitempty" toml:"allow_fingerprint,omitempty" yaml:"allow_fingerprint,omitempty" json:"allow_fingerprint,omitempty"`
+	BlockFingerprint []*matcher.Matcher `mapstructure:"block_fingerprint,omitempty" toml:"block_fingerprint,omitempty" yaml:"block_fingerprint,omitempty" json:"block_fingerprint,omitempty"`
+	// Handling of Encrypted ClientHello (sni only): allow (default), block or only
+	ECH ECHPolicy `mapstructure:"ech,omitempty" toml:"ech,omitempty" yaml:"ech,omitempty" json:"ech,omitempty"`
+
+	// Destination policy of client chosen targets (sni, http-header)
+	AllowTo       []*AddrMatcher `mapstructure:"allow_to,omitempty" toml:"allow_to,omitempty" yaml:"allow_to,omitempty" json:"allow_to,omitempty"`
+	BlockTo       []*AddrMatcher `mapstructure:"block_to,omitempty" toml:"block_to,omitempty" yaml:"block_to,omitempty" json:"block_to,omitempty"`
+	AllowInternal bool           `mapstructure:"allow_internal,omitempty" toml:"allow_internal,omitempty" yaml:"allow_internal,omitempty" json:"allow_internal,omitempty"`
+
+	Proxy   []*url.URL    `mapstructure:"proxy,omitempty" toml:"proxy,omitempty" yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	Target  string        `mapstructure:"to,omitempty" toml:"to,omitempty" yaml:"to,omitempty" json:"to,omitempty"`
+	Timeout time.Duration `mapstructure:"timeout,omitempty" toml:"timeout,omitempty" yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+	// Static backends for SNI/Host names, unmatched names are sent to the name itself
+	Routes []*Route `mapstructure:"routes,omitempty" toml:"routes,omitempty" yaml:"routes,omitempty" json:"routes,omitempty"`
+	// Backend for connections without a usable SNI/Host or without a matching tag entry
+	Fallback string `mapstructure:"fallback,omitempty" toml:"fallback,omitempty" yaml:"fallback,omitempty" json:"fallback,omitempty"`
+
+	// Header, path and forwarding rules of proxied HTTP requests (http-header, http_to_https)
+	Rewrites []*Rewrite `mapstructure:"rewrite,omitempty" toml:"rewrite,omitempty" yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+
+	// Proxy-Authorization Basic credentials required from clients (http-header)
+	Auth *ProxyAuth `mapstructure:"auth,omitempty" toml:"auth,omitempty" yaml:"auth,omitempty" json:"auth,omitempty"`
+
+	// Opt-in TLS interception of allow-listed hosts (sni, http-header CONNECT)
+	Intercept *Intercept `mapstructure:"intercept,omitempty" toml:"intercept,omitempty" yaml:"intercept,omitempty" json:"intercept,omitempty"`
+
+	// Certificates and upstream of tls-terminate entrypoints
+	TLS *TLSTerminate `mapstructure:"tls,omitempty" toml:"tls,omitempty" yaml:"tls,omitempty" json:"tls,omitempty"`
+
+	// Admission control, zero means unlimited
+	MaxConnections       int           `mapstructure:"max_connections,omitempty" toml:"max_connections,omitempty" yaml:"max_connections,omitempty" json:"max_connections,omitempty"`
+	MaxClientConnections int           `mapstructure:"max_client_connections,omitempty" toml:"max_client_connections,omitempty" yaml:"max_client_connections,omitempty" json:"max_client_connections,omitempty"`
+	QueueTimeout         time.Duration `mapstructure:"queue_timeout,omitempty" toml:"queue_timeout,omitempty" yaml:"queue_timeout,omitempty" json:"queue_timeout,omitempty"`
+
+	// Keep-alive pool of upstream HTTP connections (http-header)
+	Pool *Pool `mapstructure:"pool,omitempty" toml:"pool,omitempty" yaml:"pool,omitempty" json:"pool,omitempty"`
+
+	// Shared RFC 9111 cache of upstream HTTP responses (http-header, http-to-https)
+	Cache *Cache `mapstructure:"cache,omitempty" toml:"cache,omitempty" yaml:"cache,omitempty" json:"cache,omitempty"`
+
+	// Responses of requests refused or failed by the proxy itself (http-header, http-to-https, tls-terminate http)
+	ErrorPages *ErrorPages `mapstructure:"error_pages,omitempty" toml:"error_pages,omitempty" yaml:"error_pages,omitempty" json:"error_pages,omitempty"`
+
+	// Traffic shaping, shared by the entrypoint, per client ip and per SNI/Host pattern
+	RateLimit       *RateLimit   `mapstructure:"rate_limit,omitempty" toml:"rate_limit,omitempty" yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	ClientRateLimit *RateLimit   `mapstructure:"client_rate_limit,omitempty" toml:"client_rate_limit,omitempty" yaml:"client_rate_limit,omitempty" json:"client_rate_limit,omitempty"`
+	HostRateLimits  []*RateLimit `mapstructure:"host_rate_limit,omitempty" toml:"host_rate_limit,omitempty" yaml:"host_rate_limit,omitempty" json:"host_rate_limit,omitempty"`
+
+	// Traffic quotas, usage is shared between entrypoints using the same quota name
+	Quotas []*Quota `mapstructure:"quota,omitempty" toml:"quota,omitempty" yaml:"quota,omitempty" json:"quota,omitempty"`
 
 	// Tag used for grouping entrypoints of auto-router kind
 	Tag *string `mapstructure:"tag,omitempty" toml:"tag,omitempty" yaml:"tag,omitempty" json:"tag,omitempty"`
 
 	Features  []string       `mapstructure:"features,omitempty" toml:"features,omitempty" yaml:"features,omitempty" json:"features,omitempty"`
 	ExtraConf map[string]any `mapstructure:"extra" toml:"extra,omitempty" yaml:"extra,omitempty" json:"extra,omitempty"`
+
+	// Compiled allow_from/block_from and allow_to/block_to, see BuildACL
+	acl     *clientACL
+	destACL *destinationACL
 }
 
 type FakeDNS struct {
@@ -49,6 +107,215 @@ type FakeDNS struct {
 	Allowed    []matcher.Matcher `mapstructure:"allowed,omitempty" toml:"allowed,omitempty" yaml:"allowed,omitempty" json:"allowed,omitempty"`
 }
 
+type Route struct {
+	Hosts []*matcher.Matcher `mapstructure:"hosts,omitempty" toml:"hosts,omitempty" yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// Backend address: "ip:port", "hostname[:port]" or "unix:/path/to/socket"
+	Target string `mapstructure:"to,omitempty" toml:"to,omitempty" yaml:"to,omitempty" json:"to,omitempty"`
+}
+
+// RouteFor returns the backend of the first route matching the name.
+func (e *EntryPoint) RouteFor(name string) (string, bool) {
+	for _, r := range e.Routes {
+		for _, h := range r.Hosts {
+			if h.Match(name) {
+				return r.Target, true
+			}
+		}
+	}
+	return "", false
+}
+
+type TLSTerminate struct {
+	Certificates []*CertPair `mapstructure:"certificates,omitempty" toml:"certificates,omitempty" yaml:"certificates,omitempty" json:"certificates,omitempty"`
+	// Local CA minting certificates for names not covered by Certificates, created when missing
+	CA *CertPair `mapstructure:"ca,omitempty" toml:"ca,omitempty" yaml:"ca,omitempty" json:"ca,omitempty"`
+	// Serve HTTP after termination and reverse proxy requests instead of relaying the stream
+	HTTP bool `mapstructure:"http,omitempty" toml:"http,omitempty" yaml:"http,omitempty" json:"http,omitempty"`
+	// Re-encrypt traffic to the backend, SkipVerify disables backend certificate verification
+	Reencrypt  bool `mapstructure:"reencrypt,omitempty" toml:"reencrypt,omitempty" yaml:"reencrypt,omitempty" json:"reencrypt,omitempty"`
+	SkipVerify bool `mapstructure:"skip_verify,omitempty" toml:"skip_verify,omitempty" yaml:"skip_verify,omitempty" json:"skip_verify,omitempty"`
+}
+
+type Intercept struct {
+	// Hostnames to intercept, required, other hosts are relayed untouched
+	Hosts []*matcher.Matcher `mapstructure:"hosts,omitempty" toml:"hosts,omitempty" yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// CA used to mint leaf certificates, created when missing
+	CA *CertPair `mapstructure:"ca,omitempty" toml:"ca,omitempty" yaml:"ca,omitempty" json:"ca,omitempty"`
+	// Dump file of the exchanges, format jsonl (one HAR entry per line, default) or har
+	Dump       string `mapstructure:"dump,omitempty" toml:"dump,omitempty" yaml:"dump,omitempty" json:"dump,omitempty"`
+	DumpFormat string `mapstructure:"dump_format,omitempty" toml:"dump_format,omitempty" yaml:"dump_format,omitempty" json:"dump_format,omitempty"`
+	// Body bytes kept per message in dumps, default 64KiB
+	MaxBody    int64      `mapstructure:"max_body,omitempty" toml:"max_body,omitempty" yaml:"max_body,omitempty" json:"max_body,omitempty"`
+	SkipVerify bool       `mapstructure:"skip_verify,omitempty" toml:"skip_verify,omitempty" yaml:"skip_verify,omitempty" json:"skip_verify,omitempty"`
+	Rewrites   []*Rewrite `mapstructure:"rewrite,omitempty" toml:"rewrite,omitempty" yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+}
+
+type Pool struct {
+	// Idle connections kept in total and per upstream host, a negative max_idle_per_host disables reuse
+	MaxIdle        int           `mapstructure:"max_idle,omitempty" toml:"max_idle,omitempty" yaml:"max_idle,omitempty" json:"max_idle,omitempty"`
+	MaxIdlePerHost int           `mapstructure:"max_idle_per_host,omitempty" toml:"max_idle_per_host,omitempty" yaml:"max_idle_per_host,omitempty" json:"max_idle_per_host,omitempty"`
+	IdleTimeout    time.Duration `mapstructure:"idle_timeout,omitempty" toml:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	// Send the requests of HTTP/2 clients to upstreams over h2c (prior knowledge)
+	H2C bool `mapstructure:"h2c,omitempty" toml:"h2c,omitempty" yaml:"h2c,omitempty" json:"h2c,omitempty"`
+}
+
+type ProxyAuth struct {
+	// Realm of the Proxy-Authenticate challenge, default junction
+	Realm string `mapstructure:"realm,omitempty" toml:"realm,omitempty" yaml:"realm,omitempty" json:"realm,omitempty"`
+	// htpasswd file with user:hash lines (bcrypt, apr1, {SHA} or plain text)
+	HTPasswd string       `mapstructure:"htpasswd,omitempty" toml:"htpasswd,omitempty" yaml:"htpasswd,omitempty" json:"htpasswd,omitempty"`
+	Users    []*ProxyUser `mapstructure:"users,omitempty" toml:"users,omitempty" yaml:"users,omitempty" json:"users,omitempty"`
+}
+
+type ProxyUser struct {
+	Name string `mapstructure:"name,omitempty" toml:"name,omitempty" yaml:"name,omitempty" json:"name,omitempty"`
+	// Plain text or htpasswd hash, read from the htpasswd file when empty
+	Password string `mapstructure:"password,omitempty" toml:"password,omitempty" yaml:"password,omitempty" json:"password,omitempty"`
+	// Hostnames the user may reach, empty allows every host of the entrypoint
+	AllowList []*matcher.Matcher `mapstructure:"allow_list,omitempty" toml:"allow_list,omitempty" yaml:"allow_list,omitempty" json:"allow_list,omitempty"`
+}
+
+type Cache struct {
+	// memory (default) or disk
+	Storage string `mapstructure:"storage,omitempty" toml:"storage,omitempty" yaml:"storage,omitempty" json:"storage,omitempty"`
+	// Directory of the disk storage, created when missing
+	Dir string `mapstructure:"dir,omitempty" toml:"dir,omitempty" yaml:"dir,omitempty" json:"dir,omitempty"`
+	// Bytes of stored responses, default 64MiB in memory and 1GiB on disk
+	MaxSize int64 `mapstructure:"max_size,omitempty" toml:"max_size,omitempty" yaml:"max_size,omitempty" json:"max_size,omitempty"`
+	// Larger responses are not stored, default 8MiB
+	MaxObjectSize int64 `mapstructure:"max_object_size,omitempty" toml:"max_object_size,omitempty" yaml:"max_object_size,omitempty" json:"max_object_size,omitempty"`
+	// Clients allowed to remove stored responses with PURGE requests, purging is disabled when empty
+	PurgeFrom []*AddrMatcher `mapstructure:"purge_from,omitempty" toml:"purge_from,omitempty" yaml:"purge_from,omitempty" json:"purge_from,omitempty"`
+
+	// Compiled purge_from, see BuildACL
+	purgeACL *clientACL
+}
+
+// PurgeAllowed reports whether the client may send PURGE requests.
+func (c *Cache) PurgeAllowed(addr net.Addr) bool {
+	if len(c.PurgeFrom) == 0 {
+		return false
+	}
+	acl := c.purgeACL
+	if acl == nil {
+		var err error
+		if acl, err = newClientACL(c.PurgeFrom, nil); err != nil {
+			return false
+		}
+	}
+	return acl.allowed(addr)
+}
+
+type ErrorPages struct {
+	// Go template of the response body, inline or read from File, plain text reasons are sent when both are empty
+	Template string `mapstructure:"template,omitempty" toml:"template,omitempty" yaml:"template,omitempty" json:"template,omitempty"`
+	File     string `mapstructure:"file,omitempty" toml:"file,omitempty" yaml:"file,omitempty" json:"file,omitempty"`
+	// Content-Type of rendered pages, default text/html; charset=utf-8, html types are escaped as HTML
+	ContentType string `mapstructure:"content_type,omitempty" toml:"content_type,omitempty" yaml:"content_type,omitempty" json:"content_type,omitempty"`
+	// Status codes replacing the default of an error code, e.g. blocked_host = 404
+	Status map[string]int `mapstructure:"status,omitempty" toml:"status,omitempty" yaml:"status,omitempty" json:"status,omitempty"`
+}
+
+type CertPair struct {
+	Cert string `mapstructure:"cert,omitempty" toml:"cert,omitempty" yaml:"cert,omitempty" json:"cert,omitempty"`
+	Key  string `mapstructure:"key,omitempty" toml:"key,omitempty" yaml:"key,omitempty" json:"key,omitempty"`
+}
+
+type RateLimit struct {
+	// Hosts is only used by host_rate_limit to select the SNI/Host names the limit applies to
+	Hosts       []*matcher.Matcher `mapstructure:"hosts,omitempty" toml:"hosts,omitempty" yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	Bandwidth   int64              `mapstructure:"bandwidth,omitempty" toml:"bandwidth,omitempty" yaml:"bandwidth,omitempty" json:"bandwidth,omitempty"`         // bytes per second, both directions combined
+	Connections float64            `mapstructure:"connections,omitempty" toml:"connections,omitempty" yaml:"connections,omitempty" json:"connections,omitempty"` // new connections per second
+}
+
+type ECHPolicy string
+
+const (
+	ECHAllow ECHPolicy = "allow"
+	ECHBlock ECHPolicy = "block"
+	ECHOnly  ECHPolicy = "only"
+)
+
+func (p *ECHPolicy) Decode(from reflect.Type, val interface{}) (any, error) {
+	if from.Kind() != reflect.String || val == nil {
+		return val, nil
+	}
+	strVal, ok := val.(string)
+	if !ok {
+		return nil, errors.New("expected string value for ech")
+	}
+	switch policy := ECHPolicy(strVal); policy {
+	case "", ECHAllow, ECHBlock, ECHOnly:
+		*p = policy
+		return p, nil
+	default:
+		return nil, errors.New("invalid ech policy: " + strVal)
+	}
+}
+
+// AllowedECH reports whether the entrypoint accepts a client based on whether it uses Encrypted ClientHello.
+func (e *EntryPoint) AllowedECH(ech bool) bool {
+	switch e.ECH {
+	case ECHBlock:
+		return !ech
+	case ECHOnly:
+		return ech
+	default:
+		return true
+	}
+}
+
+type QuotaAction string
+
+const (
+	QuotaBlock    QuotaAction = "block"
+	QuotaThrottle QuotaAction = "throttle"
+)
+
+type QuotaPeriod string
+
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaWeekly  QuotaPeriod = "weekly"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+type Quota struct {
+	Name     string       `mapstructure:"name,omitempty" toml:"name,omitempty" yaml:"name,omitempty" json:"name,omitempty"`
+	From     []*net.IPNet `mapstructure:"from,omitempty" toml:"from,omitempty" yaml:"from,omitempty" json:"from,omitempty"`                 // client ranges sharing the quota, empty means every client
+	Limit    int64        `mapstructure:"limit,omitempty" toml:"limit,omitempty" yaml:"limit,omitempty" json:"limit,omitempty"`             // bytes per period, both directions combined
+	Period   QuotaPeriod  `mapstructure:"period,omitempty" toml:"period,omitempty" yaml:"period,omitempty" json:"period,omitempty"`         // daily, weekly or monthly (default)
+	Action   QuotaAction  `mapstructure:"action,omitempty" toml:"action,omitempty" yaml:"action,omitempty" json:"action,omitempty"`         // block (default) or throttle
+	Throttle int64        `mapstructure:"throttle,omitempty" toml:"throttle,omitempty" yaml:"throttle,omitempty" json:"throttle,omitempty"` // bytes per second once exhausted, used by throttle action
+}
+
+// Applies reports whether the client is accounted by the quota.
+func (q *Quota) Applies(client net.IP) bool {
+	if len(q.From) == 0 {
+		return true
+	}
+	for _, n := range q.From {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeriodKey returns the identifier of the accounting period containing t, e.g. "2025-06" for monthly quotas.
+func (q *Quota) PeriodKey(t time.Time) string {
+	t = t.UTC()
+	switch q.Period {
+	case QuotaDaily:
+		return t.Format(time.DateOnly)
+	case QuotaWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	default:
+		return t.Format("2006-01")
+	}
+}
+
 type DNSResult struct {
 	From   []*net.IPNet `mapstructure:"from,omitempty" toml:"from,omitempty" yaml:"from,omitempty" json:"from,omitempty"`
 	Result *net.IP      `mapstructure:"answer,omitempty" toml:"answer,omitempty" yaml:"answer,omitempty" json:"answer,omitempty"`
@@ -70,6 +337,16 @@ func (e *EntryPoint) GetTargetOr(def ...string) string {
 	return cmp.Or(items...)
 }
 
+// MatchHost reports whether the host rate limit applies to the name.
+func (r *RateLimit) MatchHost(name string) bool {
+	for _, h := range r.Hosts {
+		if h.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *EntryPoint) Allowed(name string) bool {
 	if len(e.BlockList) != 0 {
 		for _, b := range e.BlockList {
@@ -90,36 +367,75 @@ func (e *EntryPoint) Allowed(name string) bool {
 	return true
 }
 
-func (e *EntryPoint) AllowedFrom(addr net.Addr) bool {
-	if addr == nil {
-		return len(e.AllowFrom) == 0
+// AllowedALPN reports whether any of the protocols offered by the client matches the alpn list,
+// entrypoints without an alpn list accept every client.
+func (e *EntryPoint) AllowedALPN(protocols []string) bool {
+	if len(e.ALPN) == 0 {
+		return true
 	}
-
-	raw := addr.String()
-	from := raw
-	if host, _, err := net.SplitHostPort(raw); err == nil && host != "" {
-		from = host
-	}
-	if from == "" {
-		from = raw
+	for _, m := range e.ALPN {
+		for _, p := range protocols {
+			if m.Match(p) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	if len(e.BlockFrom) != 0 {
-		for _, b := range e.BlockFrom {
-			if b.Match(from) {
+// AllowedFingerprint reports whether a client with the given fingerprints (JA3 hash, JA4) is accepted.
+// Every matcher is checked against all fingerprints, block rules are applied before allow rules.
+// Clients without fingerprints are rejected when allow_fingerprint is specified.
+func (e *EntryPoint) AllowedFingerprint(fingerprints ...string) bool {
+	for _, b := range e.BlockFingerprint {
+		for _, fp := range fingerprints {
+			if fp != "" && b.Match(fp) {
 				return false
 			}
 		}
 	}
-	if len(e.AllowFrom) != 0 {
-		for _, a := range e.AllowFrom {
-			if a.Match(from) {
+	if len(e.AllowFingerprint) == 0 {
+		return true
+	}
+	for _, a := range e.AllowFingerprint {
+		for _, fp := range fingerprints {
+			if fp != "" && a.Match(fp) {
 				return true
 			}
 		}
-		return false
 	}
-	return true
+	return false
+}
+
+// BuildACL compiles client, destination and purge access lists into prefix tries, copies of the entrypoint made afterwards share the result.
+func (e *EntryPoint) BuildACL() error {
+	acl, err := newClientACL(e.AllowFrom, e.BlockFrom)
+	if err != nil {
+		return err
+	}
+	destACL, err := newDestinationACL(e.AllowTo, e.BlockTo, e.AllowInternal)
+	if err != nil {
+		return err
+	}
+	if e.Cache != nil && len(e.Cache.PurgeFrom) != 0 {
+		if e.Cache.purgeACL, err = newClientACL(e.Cache.PurgeFrom, nil); err != nil {
+			return fmt.Errorf("cache.purge_from: %w", err)
+		}
+	}
+	e.acl = acl
+	e.destACL = destACL
+	return nil
+}
+
+func (e *EntryPoint) AllowedFrom(addr net.Addr) bool {
+	acl := e.acl
+	if acl == nil {
+		var err error
+		if acl, err = newClientACL(e.AllowFrom, e.BlockFrom); err != nil {
+			return false
+		}
+	}
+	return acl.allowed(addr)
 }
 
 func (e *EntryPoint) Decode(from reflect.Type, val interface{}) (any, error) {
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// internalDestinations are refused by default unless allow_internal is set or they are listed in allow_to.
+var internalDestinations = []string{
+	"0.0.0.0/8",          // "this" network
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, includes cloud metadata (169.254.169.254)
+	"100.100.100.200/32", // alibaba cloud metadata
+	"10.0.0.0/8",         // private (RFC 1918)
+	"172.16.0.0/12",      // private (RFC 1918)
+	"192.168.0.0/16",     // private (RFC 1918)
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"fe80::/10",          // link-local
+	"fc00::/7",           // unique local
+	"fd00:ec2::254/128",  // aws metadata (IPv6)
+}
+
+// destinationACL holds the compiled allow_to/block_to lists of an entrypoint.
+type destinationACL struct {
+	allow    *addrSet
+	block    *addrSet
+	internal *addrSet // nil when internal destinations are allowed
+}
+
+func newDestinationACL(allow, block []*AddrMatcher, allowInternal bool) (*destinationACL, error) {
+	a, err := newAddrSet(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow_to: %w", err)
+	}
+	b, err := newAddrSet(block)
+	if err != nil {
+		return nil, fmt.Errorf("block_to: %w", err)
+	}
+	acl := &destinationACL{allow: a, block: b}
+	if allowInternal {
+		return acl, nil
+	}
+
+	internal := make([]*AddrMatcher, len(internalDestinations))
+	for i, raw := range internalDestinations {
+		prefix := netip.MustParsePrefix(raw)
+		internal[i] = &AddrMatcher{Prefix: &prefix, raw: raw}
+	}
+	if acl.internal, err = newAddrSet(internal); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (acl *destinationACL) allowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	from := ip.String()
+	switch {
+	case acl.block.match(ip, from):
+		return false
+	case acl.allow.match(ip, from):
+		return true
+	case !acl.allow.empty():
+		return false
+	case acl.internal != nil && acl.internal.match(ip, from):
+		return false
+	default:
+		return true
+	}
+}
+
+// DestinationAllowed reports whether the entrypoint may connect to the ip.
+// Block rules are applied first, then allow rules, then the default internal ranges
+// (loopback, link-local, private and cloud metadata addresses) unless allow_internal is set.
+func (e *EntryPoint) DestinationAllowed(ip net.IP) bool {
+	acl := e.destACL
+	if acl == nil {
+		var err error
+		if acl, err = newDestinationACL(e.AllowTo, e.BlockTo, e.AllowInternal); err != nil {
+			return false
+		}
+	}
+	return acl.allowed(ip)
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/fmotalleb/go-tools/matcher"
+)
+
+// Rewrite modifies HTTP requests and responses whose host and path match.
+type Rewrite struct {
+	// Empty Hosts matches every host
+	Hosts []*matcher.Matcher `mapstructure:"hosts,omitempty" toml:"hosts,omitempty" yaml:"hosts,omitempty" json:"hosts,omitempty"`
+	// Regular expression matched against the request path, empty matches every path
+	Path string `mapstructure:"path,omitempty" toml:"path,omitempty" yaml:"path,omitempty" json:"path,omitempty"`
+	// Replacement of the path expression ($1 expands submatches), an empty string strips the match
+	PathReplace *string `mapstructure:"path_replace,omitempty" toml:"path_replace,omitempty" yaml:"path_replace,omitempty" json:"path_replace,omitempty"`
+	// Inject X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto, X-Real-IP and Forwarded into requests
+	Forwarded bool `mapstructure:"forwarded,omitempty" toml:"forwarded,omitempty" yaml:"forwarded,omitempty" json:"forwarded,omitempty"`
+
+	RequestHeaders  *HeaderOps `mapstructure:"request_headers,omitempty" toml:"request_headers,omitempty" yaml:"request_headers,omitempty" json:"request_headers,omitempty"`
+	ResponseHeaders *HeaderOps `mapstructure:"response_headers,omitempty" toml:"response_headers,omitempty" yaml:"response_headers,omitempty" json:"response_headers,omitempty"`
+	// Literal replacements applied to textual, uncompressed response bodies
+	ReplaceBody []*Replacement `mapstructure:"replace_body,omitempty" toml:"replace_body,omitempty" yaml:"replace_body,omitempty" json:"replace_body,omitempty"`
+
+	path *regexp.Regexp
+}
+
+type HeaderOps struct {
+	Add    map[string]string `mapstructure:"add,omitempty" toml:"add,omitempty" yaml:"add,omitempty" json:"add,omitempty"`
+	Set    map[string]string `mapstructure:"set,omitempty" toml:"set,omitempty" yaml:"set,omitempty" json:"set,omitempty"`
+	Remove []string          `mapstructure:"remove,omitempty" toml:"remove,omitempty" yaml:"remove,omitempty" json:"remove,omitempty"`
+}
+
+type Replacement struct {
+	From string `mapstructure:"from,omitempty" toml:"from,omitempty" yaml:"from,omitempty" json:"from,omitempty"`
+	To   string `mapstructure:"to,omitempty" toml:"to,omitempty" yaml:"to,omitempty" json:"to,omitempty"`
+}
+
+// Compile parses the path expression, copies of the rewrite made afterwards share the result.
+func (r *Rewrite) Compile() error {
+	if r.Path == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.Path)
+	if err != nil {
+		return fmt.Errorf("invalid rewrite path %q: %w", r.Path, err)
+	}
+	r.path = re
+	return nil
+}
+
+// Matches reports whether the rewrite applies to the request host (without port) and path.
+func (r *Rewrite) Matches(host, path string) bool {
+	if len(r.Hosts) != 0 {
+		matched := false
+		for _, h := range r.Hosts {
+			if h.Match(host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.Path == "" {
+		return true
+	}
+	if r.path == nil {
+		// Not compiled, treat an invalid expression as not matching
+		if r.Compile() != nil {
+			return false
+		}
+	}
+	return r.path.MatchString(path)
+}
+
+// RewritePath applies path_replace to a path matched by the rewrite, other paths are returned as is.
+func (r *Rewrite) RewritePath(path string) string {
+	if r.PathReplace == nil || r.path == nil {
+		return path
+	}
+	return r.path.ReplaceAllString(path, *r.PathReplace)
+}
+
+// BodyReplacer returns the replacer of replace_body, nil when there are no replacements.
+func (r *Rewrite) BodyReplacer() *strings.Replacer {
+	if len(r.ReplaceBody) == 0 {
+		return nil
+	}
+	pairs := make([]string, 0, len(r.ReplaceBody)*2)
+	for _, rep := range r.ReplaceBody {
+		if rep != nil && rep.From != "" {
+			pairs = append(pairs, rep.From, rep.To)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// Apply removes, sets and adds headers, in that order. A nil receiver is a no-op.
+func (h *HeaderOps) Apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, k := range h.Remove {
+		header.Del(k)
+	}
+	for k, v := range h.Set {
+		header.Set(k, v)
+	}
+	for k, v := range h.Add {
+		header.Add(k, v)
+	}
+}
@@ -8,11 +8,12 @@ import (
 type Router string
 
 const (
-	RouterHTTPHeader  Router = "http-header"
-	RouterSNI         Router = "sni"
-	RouterTCPRaw      Router = "tcp-raw"
-	RouterUDPRaw      Router = "udp-raw"
-	RouterHTTPToHTTPS Router = "http-to-https"
+	RouterHTTPHeader   Router = "http-header"
+	RouterSNI          Router = "sni"
+	RouterTCPRaw       Router = "tcp-raw"
+	RouterUDPRaw       Router = "udp-raw"
+	RouterHTTPToHTTPS  Router = "http-to-https"
+	RouterTLSTerminate Router = "tls-terminate"
 )
 
 func (r *Router) Decode(from reflect.Type, val interface{}) (any, error) {
@@ -38,7 +39,7 @@ func (r *Router) Decode(from reflect.Type, val interface{}) (any, error) {
 
 func (r *Router) IsValid() bool {
 	switch *r {
-	case RouterHTTPHeader, RouterSNI, RouterTCPRaw, RouterUDPRaw, RouterHTTPToHTTPS:
+	case RouterHTTPHeader, RouterSNI, RouterTCPRaw, RouterUDPRaw, RouterHTTPToHTTPS, RouterTLSTerminate:
 		return true
 	default:
 		return false
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fmotalleb/go-tools/env"
 	"go.uber.org/zap"
 
 	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/quota"
 )
 
 type UDPClientManager struct {
@@ -19,12 +21,15 @@ type UDPClientManager struct {
 	entry      config.EntryPoint
 	clients    map[string]*UDPClientConn
 	clientsMux sync.RWMutex
+	// Closed once draining and the last client is gone, nil until Drain is called
+	drained chan struct{}
 }
 
 type UDPClientConn struct {
 	clientAddr *net.UDPAddr
-	targetConn *net.UDPConn
-	lastSeen   time.Time
+	// Charges both directions to the quotas of the client
+	targetConn net.Conn
+	lastSeen   atomic.Int64 // unix nanoseconds, updated by both directions
 	cancel     context.CancelFunc
 }
 
@@ -51,10 +56,15 @@ func (m *UDPClientManager) HandlePacket(clientAddr *net.UDPAddr, data []byte, se
 		}
 	}
 
-	client.lastSeen = time.Now()
+	client.lastSeen.Store(time.Now().UnixNano())
 
 	// Forward packet to target
 	_, err := client.targetConn.Write(data)
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		m.logger.Warn("traffic quota exceeded", zap.String("client", clientKey))
+		m.removeClient(clientKey)
+		return
+	}
 	if err != nil {
 		m.logger.Error("failed to forward packet to target",
 			zap.String("client", clientKey),
@@ -63,6 +73,19 @@ func (m *UDPClientManager) HandlePacket(clientAddr *net.UDPAddr, data []byte, se
 	}
 }
 
+// Drain stops creating connections for new clients, the returned channel is closed once the open ones are gone.
+func (m *UDPClientManager) Drain() <-chan struct{} {
+	m.clientsMux.Lock()
+	defer m.clientsMux.Unlock()
+	if m.drained == nil {
+		m.drained = make(chan struct{})
+		if len(m.clients) == 0 {
+			close(m.drained)
+		}
+	}
+	return m.drained
+}
+
 func (m *UDPClientManager) Cleanup() {
 	m.clientsMux.Lock()
 	defer m.clientsMux.Unlock()
@@ -76,6 +99,14 @@ func (m *UDPClientManager) Cleanup() {
 func (m *UDPClientManager) createClientConnection(clientAddr *net.UDPAddr, serverConn *net.UDPConn) *UDPClientConn {
 	clientKey := clientAddr.String()
 
+	meter := quota.NewMeter(m.ctx, quota.Current(), m.entry.Quotas, clientAddr.IP)
+	if meter != nil {
+		if err := meter.Check(); err != nil {
+			m.logger.Warn("packet rejected", zap.String("client", clientKey), zap.Error(err))
+			return nil
+		}
+	}
+
 	// Create connection to target
 	targetConn, err := m.dialTarget()
 	if err != nil {
@@ -85,12 +116,19 @@ func (m *UDPClientManager) createClientConnection(clientAddr *net.UDPAddr, serve
 	ctx, cancel := context.WithCancel(m.ctx)
 	client := &UDPClientConn{
 		clientAddr: clientAddr,
-		targetConn: targetConn,
-		lastSeen:   time.Now(),
+		targetConn: quota.WrapConn(targetConn, meter),
 		cancel:     cancel,
 	}
+	client.lastSeen.Store(time.Now().UnixNano())
 
 	m.clientsMux.Lock()
+	if m.drained != nil {
+		m.clientsMux.Unlock()
+		cancel()
+		_ = targetConn.Close()
+		m.logger.Debug("packet of new client dropped while draining", zap.String("client", clientKey))
+		return nil
+	}
 	m.clients[clientKey] = client
 	m.clientsMux.Unlock()
 
@@ -177,7 +215,7 @@ func (m *UDPClientManager) handleTargetResponses(ctx context.Context, client *UD
 			break
 		}
 
-		client.lastSeen = time.Now()
+		client.lastSeen.Store(time.Now().UnixNano())
 	}
 
 	m.removeClient(clientKey)
@@ -205,7 +243,7 @@ func (m *UDPClientManager) clientCleanupTimer(ctx context.Context, clientKey str
 				return
 			}
 
-			if time.Since(client.lastSeen) > timeout {
+			if time.Since(time.Unix(0, client.lastSeen.Load())) > timeout {
 				m.logger.Debug("cleaning up idle UDP client", zap.String("client", clientKey))
 				m.removeClient(clientKey)
 				return
@@ -221,5 +259,8 @@ func (m *UDPClientManager) removeClient(clientKey string) {
 	if client, exists := m.clients[clientKey]; exists {
 		client.cancel()
 		delete(m.clients, clientKey)
+		if m.drained != nil && len(m.clients) == 0 {
+			close(m.drained)
+		}
 	}
 }
@@ -0,0 +1,54 @@
+package certs_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/crypto/certs"
+)
+
+func TestLocalCAMintsTrustedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca", "ca.pem"), filepath.Join(dir, "ca", "ca-key.pem")
+
+	ca, err := certs.LoadOrCreateCA(certFile, keyFile)
+	assert.NoError(t, err)
+	leaf, err := ca.Certificate("app.internal")
+	assert.NoError(t, err)
+	cached, err := ca.Certificate("app.internal")
+	assert.NoError(t, err)
+	assert.True(t, leaf == cached, "leaf certificates must be cached")
+
+	// Reloading must keep the same CA
+	reloaded, err := certs.LoadOrCreateCA(certFile, keyFile)
+	assert.NoError(t, err)
+	other, err := reloaded.Certificate("app.internal")
+	assert.NoError(t, err)
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	root, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	for _, c := range []*tls.Certificate{leaf, other} {
+		_, err = c.Leaf.Verify(x509.VerifyOptions{DNSName: "app.internal", Roots: roots})
+		assert.NoError(t, err)
+	}
+}
+
+func TestStoreHonoursAllow(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := certs.LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	assert.NoError(t, err)
+	store := certs.NewStore(nil, ca, func(name string) bool { return name == "allowed.internal" })
+
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "allowed.internal"})
+	assert.NoError(t, err)
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.internal"})
+	assert.IsError(t, err, certs.ErrNoCertificate)
+}
@@ -0,0 +1,51 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+var ErrNoCertificate = errors.New("no certificate for server name")
+
+// Store selects certificates by server name. Static certificates are preferred,
+// names they do not cover are minted by the CA when allowed.
+type Store struct {
+	certs []tls.Certificate
+	ca    *CA
+	allow func(name string) bool
+}
+
+// NewStore returns a store serving certs and, when ca is not nil, minting certificates for names accepted by allow.
+func NewStore(certs []tls.Certificate, ca *CA, allow func(name string) bool) *Store {
+	return &Store{certs: certs, ca: ca, allow: allow}
+}
+
+// LoadPairs loads PEM certificate/key file pairs.
+func LoadPairs(pairs [][2]string) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(pairs))
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for i := range s.certs {
+		if hello.SupportsCertificate(&s.certs[i]) == nil {
+			return &s.certs[i], nil
+		}
+	}
+	name := hello.ServerName
+	if s.ca != nil && name != "" && (s.allow == nil || s.allow(name)) {
+		return s.ca.Certificate(name)
+	}
+	if len(s.certs) != 0 {
+		return &s.certs[0], nil
+	}
+	return nil, ErrNoCertificate
+}
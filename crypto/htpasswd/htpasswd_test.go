@@ -0,0 +1,41 @@
+package htpasswd_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/fmotalleb/junction/crypto/htpasswd"
+)
+
+func TestVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	hashes := []string{
+		string(bcryptHash),
+		"$apr1$r31Ywh5q$wpljihABvRuxc9v6ZuAu21",
+		"$1$saltsalt$9xy1btjgzLYfb7hivXtC//",
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"secret",
+	}
+	for _, hash := range hashes {
+		assert.True(t, htpasswd.Verify(hash, "secret"), "hash %s", hash)
+		assert.False(t, htpasswd.Verify(hash, "Secret"), "hash %s", hash)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte("# users\nalice:$apr1$r31Ywh5q$wpljihABvRuxc9v6ZuAu21\n\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600))
+	users, err := htpasswd.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(users))
+	assert.True(t, htpasswd.Verify(users["alice"], "secret"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("broken\n"), 0o600))
+	_, err = htpasswd.Load(path)
+	assert.Error(t, err)
+}
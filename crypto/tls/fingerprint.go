@@ -0,0 +1,200 @@
+package tls
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined over MD5
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+)
+
+const (
+	// JA3Len is the length of the hex encoded JA3 hash.
+	JA3Len = md5.Size * 2
+	// JA4Len is the length of a JA4 fingerprint (JA4_a + "_" + JA4_b + "_" + JA4_c).
+	JA4Len = 10 + 1 + 12 + 1 + 12
+
+	// fingerprintBufSize fits the fingerprint strings of common hellos, larger ones spill to the heap.
+	fingerprintBufSize = 1024
+)
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), ignored by both fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// AppendJA3 appends the hex encoded JA3 hash of the hello to dst.
+// The JA3 string is "version,ciphers,extensions,groups,point formats" with GREASE values removed.
+func (out *ClientHello) AppendJA3(dst []byte) []byte {
+	var buf [fingerprintBufSize]byte
+	b := strconv.AppendUint(buf[:0], uint64(out.Version), 10)
+	b = append(b, ',')
+	b = appendDecimalList(b, out.CipherSuites)
+	b = append(b, ',')
+	b = appendDecimalList(b, out.Extensions[:out.ExtensionCount])
+	b = append(b, ',')
+	b = appendDecimalList(b, out.SupportedGroups[:out.SupportedGroupCount])
+	b = append(b, ',')
+	for i, f := range out.PointFormats {
+		if i > 0 {
+			b = append(b, '-')
+		}
+		b = strconv.AppendUint(b, uint64(f), 10)
+	}
+
+	sum := md5.Sum(b) //nolint:gosec // JA3 is defined over MD5
+	return hex.AppendEncode(dst, sum[:])
+}
+
+// AppendJA4 appends the JA4 fingerprint of the hello (TCP) to dst, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1".
+func (out *ClientHello) AppendJA4(dst []byte) []byte {
+	dst = out.appendJA4Prefix(dst)
+	dst = append(dst, '_')
+
+	var sorted [64]uint16
+	ciphers := appendNonGREASE(sorted[:0], out.CipherSuites)
+	slices.Sort(ciphers)
+	var buf [fingerprintBufSize]byte
+	dst = appendTruncatedHash(dst, appendHexList(buf[:0], ciphers))
+	dst = append(dst, '_')
+
+	exts := sorted[:0]
+	for _, e := range out.Extensions[:out.ExtensionCount] {
+		if e != extServerName && e != extALPN && !isGREASE(e) {
+			exts = append(exts, e)
+		}
+	}
+	slices.Sort(exts)
+	b := appendHexList(buf[:0], exts)
+	if out.SignatureAlgorithmCount > 0 {
+		b = append(b, '_')
+		b = appendHexList(b, out.SignatureAlgorithms[:out.SignatureAlgorithmCount])
+	}
+	if len(exts) == 0 {
+		b = b[:0]
+	}
+	return appendTruncatedHash(dst, b)
+}
+
+// appendJA4Prefix appends JA4_a: protocol, version, sni flag, cipher and extension counts and ALPN.
+func (out *ClientHello) appendJA4Prefix(dst []byte) []byte {
+	dst = append(dst, 't')
+	dst = append(dst, ja4Version(out.maxVersion())...)
+	if out.SNICount > 0 {
+		dst = append(dst, 'd')
+	} else {
+		dst = append(dst, 'i')
+	}
+
+	ciphers, exts := 0, 0
+	for _, c := range out.CipherSuites {
+		if !isGREASE(c) {
+			ciphers++
+		}
+	}
+	for _, e := range out.Extensions[:out.ExtensionCount] {
+		if !isGREASE(e) {
+			exts++
+		}
+	}
+	dst = appendTwoDigits(dst, ciphers)
+	dst = appendTwoDigits(dst, exts)
+
+	if out.ALPNCount == 0 {
+		return append(dst, '0', '0')
+	}
+	alpn := out.ALPNProtocols[0]
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return append(dst, first, last)
+	}
+	const digits = "0123456789abcdef"
+	return append(dst, digits[first>>4], digits[last&0x0f])
+}
+
+// maxVersion returns the highest version offered in supported_versions, or the legacy hello version.
+func (out *ClientHello) maxVersion() uint16 {
+	var highest uint16
+	for _, v := range out.SupportedVersions[:out.SupportedVersionCount] {
+		if !isGREASE(v) && v > highest {
+			highest = v
+		}
+	}
+	if highest == 0 {
+		return out.Version
+	}
+	return highest
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+func appendTwoDigits(dst []byte, n int) []byte {
+	n = min(n, 99)
+	return append(dst, byte('0'+n/10), byte('0'+n%10))
+}
+
+func isAlphanumeric(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func appendNonGREASE(dst, values []uint16) []uint16 {
+	for _, v := range values {
+		if !isGREASE(v) {
+			dst = append(dst, v)
+		}
+	}
+	return dst
+}
+
+// appendDecimalList appends the non GREASE values as a dash separated decimal list.
+func appendDecimalList(dst []byte, values []uint16) []byte {
+	sep := false
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if sep {
+			dst = append(dst, '-')
+		}
+		dst = strconv.AppendUint(dst, uint64(v), 10)
+		sep = true
+	}
+	return dst
+}
+
+// appendHexList appends the values as a comma separated list of 4 digit hex numbers.
+func appendHexList(dst []byte, values []uint16) []byte {
+	for i, v := range values {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = hex.AppendEncode(dst, []byte{byte(v >> 8), byte(v)})
+	}
+	return dst
+}
+
+// appendTruncatedHash appends the first 12 hex characters of the SHA256 of data, or zeros when data is empty.
+func appendTruncatedHash(dst, data []byte) []byte {
+	if len(data) == 0 {
+		return append(dst, "000000000000"...)
+	}
+	sum := sha256.Sum256(data)
+	return hex.AppendEncode(dst, sum[:6])
+}
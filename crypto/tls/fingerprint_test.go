@@ -0,0 +1,46 @@
+package tls_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/crypto/tls"
+)
+
+const (
+	curlJA3 = "32e4b8812cda0c0d50783b438492a769"
+	curlJA4 = "t13d3013h2_1d37bd780c83_8537cf56674e"
+)
+
+func TestFingerprints(t *testing.T) {
+	for domain, data := range testData {
+		info := new(tls.ClientHello)
+		assert.NoError(t, info.Unmarshal(data), "failed to parse")
+		assert.Equal(t, curlJA3, string(info.AppendJA3(nil)), domain)
+		assert.Equal(t, curlJA4, string(info.AppendJA4(nil)), domain)
+	}
+}
+
+func TestFingerprintsNoAlloc(t *testing.T) {
+	info := new(tls.ClientHello)
+	assert.NoError(t, info.Unmarshal(testData[benchmarkOn]))
+	var buf [tls.JA3Len + tls.JA4Len]byte
+	allocs := testing.AllocsPerRun(100, func() {
+		info.AppendJA4(info.AppendJA3(buf[:0]))
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkFingerprints(b *testing.B) {
+	info := new(tls.ClientHello)
+	if info.Unmarshal(testData[benchmarkOn]) != nil {
+		b.Fail()
+	}
+	var buf [tls.JA3Len + tls.JA4Len]byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		info.AppendJA4(info.AppendJA3(buf[:0]))
+	}
+}
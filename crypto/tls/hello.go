@@ -20,6 +20,49 @@ type ClientHello struct {
 	CompressionMethods []byte
 	SNIHostNames       [4][]byte // limit to 4 names to avoid dynamic append
 	SNICount           int
+	ALPNProtocols      [8][]byte // limit to 8 protocols to avoid dynamic append
+	ALPNCount          int
+
+	// ECH is set when the encrypted_client_hello extension is present, SNIHostNames then holds the
+	// outer (public) name while the real name is encrypted. GREASE ECH is indistinguishable by design.
+	ECH bool
+
+	// Fingerprinting data, see JA3 and JA4. Lists are limited to avoid dynamic append.
+	Extensions              [64]uint16 // extension types in the order sent
+	ExtensionCount          int
+	SupportedGroups         [32]uint16
+	SupportedGroupCount     int
+	PointFormats            []byte
+	SignatureAlgorithms     [32]uint16
+	SignatureAlgorithmCount int
+	SupportedVersions       [8]uint16
+	SupportedVersionCount   int
+}
+
+const (
+	extServerName           = 0x00
+	extSupportedGroups      = 0x0a
+	extPointFormats         = 0x0b
+	extSignatureAlgorithms  = 0x0d
+	extALPN                 = 0x10
+	extSupportedVersions    = 0x2b
+	extEncryptedClientHello = 0xfe0d
+)
+
+// PublicName returns the outer server name of an ECH hello, nil when ECH is not used.
+func (out *ClientHello) PublicName() []byte {
+	if !out.ECH {
+		return nil
+	}
+	return out.ServerName()
+}
+
+// ServerName returns the first host name of the SNI extension, nil when missing.
+func (out *ClientHello) ServerName() []byte {
+	if out.SNICount == 0 {
+		return nil
+	}
+	return out.SNIHostNames[0]
 }
 
 func (out *ClientHello) parseClientHelloBody(hello []byte) (int, error) {
@@ -86,7 +129,7 @@ func (out *ClientHello) Unmarshal(buf []byte) error {
 	}
 	if pos+2 > len(hello) {
 		// No extensions
-		out.SNICount = 0
+		out.resetExtensions()
 		return nil
 	}
 
@@ -97,7 +140,7 @@ func (out *ClientHello) Unmarshal(buf []byte) error {
 	}
 
 	extEnd := pos + extLen
-	out.SNICount = 0
+	out.resetExtensions()
 	out.parseExtensions(hello, pos, extEnd)
 	return nil
 }
@@ -135,6 +178,68 @@ func (out *ClientHello) parseSNIExtension(data []byte) {
 	}
 }
 
+// parseALPNExtension parses the protocol name list (RFC 7301) and populates ALPNProtocols and ALPNCount.
+func (out *ClientHello) parseALPNExtension(data []byte) {
+	listEnd := 2 + int(binary.BigEndian.Uint16(data))
+	if listEnd > len(data) {
+		return
+	}
+	for pos := 2; pos < listEnd && out.ALPNCount < len(out.ALPNProtocols); {
+		nameLen := int(data[pos])
+		pos++
+		if nameLen == 0 || pos+nameLen > listEnd {
+			return
+		}
+		out.ALPNProtocols[out.ALPNCount] = data[pos : pos+nameLen]
+		out.ALPNCount++
+		pos += nameLen
+	}
+}
+
+func (out *ClientHello) resetExtensions() {
+	out.SNICount = 0
+	out.ALPNCount = 0
+	out.ExtensionCount = 0
+	out.SupportedGroupCount = 0
+	out.PointFormats = nil
+	out.SignatureAlgorithmCount = 0
+	out.SupportedVersionCount = 0
+	out.ECH = false
+}
+
+// parseExtension parses a single extension body.
+func (out *ClientHello) parseExtension(extType uint16, data []byte) {
+	switch {
+	case extType == extServerName && len(data) >= 2:
+		out.parseSNIExtension(data)
+	case extType == extALPN && len(data) >= 2:
+		out.parseALPNExtension(data)
+	case extType == extSupportedGroups && len(data) >= 2:
+		out.SupportedGroupCount = parseUint16List(data[2:], int(binary.BigEndian.Uint16(data)), out.SupportedGroups[:])
+	case extType == extSignatureAlgorithms && len(data) >= 2:
+		out.SignatureAlgorithmCount = parseUint16List(data[2:], int(binary.BigEndian.Uint16(data)), out.SignatureAlgorithms[:])
+	case extType == extSupportedVersions && len(data) >= 1:
+		out.SupportedVersionCount = parseUint16List(data[1:], int(data[0]), out.SupportedVersions[:])
+	case extType == extEncryptedClientHello:
+		out.ECH = true
+	case extType == extPointFormats && len(data) >= 1:
+		if n := int(data[0]); 1+n <= len(data) {
+			out.PointFormats = data[1 : 1+n]
+		}
+	}
+}
+
+// parseUint16List copies a length prefixed list of uint16 values into dst and returns the count.
+func parseUint16List(data []byte, listLen int, dst []uint16) int {
+	listLen = min(listLen, len(data))
+	count := 0
+	for pos := 0; pos+2 <= listLen && count < len(dst); pos += 2 {
+		dst[count] = binary.BigEndian.Uint16(data[pos:])
+		count++
+	}
+	return count
+}
+
 // parseExtensions parses the extensions in the ClientHello message.
 func (out *ClientHello) parseExtensions(hello []byte, pos, extEnd int) {
 	for pos+4 <= extEnd {
@@ -146,9 +251,11 @@ func (out *ClientHello) parseExtensions(hello []byte, pos, extEnd int) {
 			break
 		}
 
-		if extType == 0x00 && extDataLen >= 2 {
-			out.parseSNIExtension(hello[pos : pos+extDataLen])
+		if out.ExtensionCount < len(out.Extensions) {
+			out.Extensions[out.ExtensionCount] = extType
+			out.ExtensionCount++
 		}
+		out.parseExtension(extType, hello[pos:pos+extDataLen])
 		pos += extDataLen
 	}
 }
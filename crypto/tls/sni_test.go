@@ -2,8 +2,10 @@ package tls_test
 
 import (
 	"embed"
+	"encoding/binary"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -58,6 +60,18 @@ func TestUnmarshalClientHello(t *testing.T) {
 	}
 }
 
+func TestUnmarshalClientHelloALPN(t *testing.T) {
+	for domain, data := range testData {
+		info := new(tls.ClientHello)
+		assert.NoError(t, info.Unmarshal(data), "failed to parse")
+		protocols := make([]string, info.ALPNCount)
+		for i := range protocols {
+			protocols[i] = string(info.ALPNProtocols[i])
+		}
+		assert.SliceContains(t, protocols, "http/1.1", domain)
+	}
+}
+
 func BenchmarkExtractSNI(b *testing.B) {
 	data := testData[benchmarkOn]
 	b.SetBytes(int64(len(data)))
@@ -78,3 +92,37 @@ func BenchmarkUnmarshalClientHello(b *testing.B) {
 		}
 	}
 }
+
+// withExtension appends an extension to a captured ClientHello, fixing up the record, handshake and extension lengths.
+func withExtension(data []byte, extType uint16, body []byte) []byte {
+	const extLenPos = 5 + 4 // record header + handshake header
+	out := append(slices.Clone(data), byte(extType>>8), byte(extType), byte(len(body)>>8), byte(len(body)))
+	out = append(out, body...)
+	added := 4 + len(body)
+
+	binary.BigEndian.PutUint16(out[3:], binary.BigEndian.Uint16(out[3:])+uint16(added))
+	hsLen := int(out[6])<<16 | int(binary.BigEndian.Uint16(out[7:])) + added
+	out[6], out[7], out[8] = byte(hsLen>>16), byte(hsLen>>8), byte(hsLen)
+
+	pos := extLenPos + 2 + 32
+	pos += 1 + int(out[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(out[pos:]))
+	pos += 1 + int(out[pos])
+	binary.BigEndian.PutUint16(out[pos:], binary.BigEndian.Uint16(out[pos:])+uint16(added))
+	return out
+}
+
+func TestUnmarshalClientHelloECH(t *testing.T) {
+	data := testData[benchmarkOn]
+	info := new(tls.ClientHello)
+	assert.NoError(t, info.Unmarshal(data))
+	assert.False(t, info.ECH)
+	assert.Zero(t, info.PublicName())
+
+	// outer ECH payload: type, cipher suite, config id, enc and payload lengths
+	ech := []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x2a, 0x00, 0x00, 0x00, 0x00}
+	assert.NoError(t, info.Unmarshal(withExtension(data, 0xfe0d, ech)))
+	assert.True(t, info.ECH)
+	assert.Equal(t, benchmarkOn, string(info.PublicName()))
+	assert.Equal(t, benchmarkOn, string(tls.ExtractSNI(withExtension(data, 0xfe0d, ech))))
+}
@@ -116,13 +116,13 @@ func Serve(ctx context.Context, cfg config.FakeDNS) error {
 		logger.Error("failed to start server", zap.Error(err))
 		return err
 	}
-	// go func() {
-	// 	<-ctx.Done()
-	// 	logger.Info("context deadline reached")
-	// 	if err := l.Close(); err != nil {
-	// 		logger.Info("failed to close listener", zap.Error(err))
-	// 	}
-	// }()
+	stop := context.AfterFunc(ctx, func() {
+		logger.Info("context canceled, closing listener")
+		if err := l.Close(); err != nil {
+			logger.Info("failed to close listener", zap.Error(err))
+		}
+	})
+	defer stop()
 	logger.Info("dns server started")
 	if serverErr := dns.ActivateAndServe(nil, l, h); serverErr != nil {
 		select {
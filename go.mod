@@ -10,8 +10,10 @@ tool (
 
 require (
 	github.com/alecthomas/assert/v2 v2.11.0
+	github.com/andybalholm/brotli v1.2.0
 	github.com/fmotalleb/go-tools v0.1.73
 	github.com/go-viper/mapstructure/v2 v2.5.0
+	github.com/klauspost/compress v1.18.0
 	github.com/miekg/dns v1.1.72
 	github.com/pelletier/go-toml v1.9.5
 	github.com/sethvargo/go-retry v0.3.0
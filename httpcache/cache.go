@@ -0,0 +1,344 @@
+// Package httpcache is a shared HTTP cache (RFC 9111) wrapping the upstream transport of the HTTP routers.
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+const (
+	defaultMemorySize    = 64 << 20
+	defaultDiskSize      = 1 << 30
+	defaultMaxObjectSize = 8 << 20
+
+	// Separates the URL and the selecting header values in the keys of variants
+	variantSep = "\x00"
+)
+
+// Cache statuses, reported in logs and in the Cache-Status header (RFC 9211).
+const (
+	StatusHit         = "hit"
+	StatusMiss        = "miss"
+	StatusRevalidated = "revalidated"
+	StatusExpired     = "expired"
+	StatusBypass      = "bypass"
+)
+
+var cacheStatus = map[string]string{
+	StatusHit:         "junction; hit",
+	StatusMiss:        "junction; fwd=uri-miss",
+	StatusRevalidated: "junction; fwd=stale; fwd-status=304",
+	StatusExpired:     "junction; fwd=stale",
+	StatusBypass:      "junction; fwd=bypass",
+}
+
+// Cache stores upstream responses of an entrypoint.
+type Cache struct {
+	cfg       *config.Cache
+	store     Storage
+	maxObject int64
+	logger    *zap.Logger
+}
+
+// New opens the storage of cfg, disk storages keep the entries of previous runs.
+func New(cfg *config.Cache, logger *zap.Logger) (*Cache, error) {
+	c := &Cache{cfg: cfg, maxObject: cfg.MaxObjectSize, logger: logger}
+	if c.maxObject <= 0 {
+		c.maxObject = defaultMaxObjectSize
+	}
+	switch cfg.Storage {
+	case "", "memory":
+		c.store = newMemoryStore(orDefault(cfg.MaxSize, defaultMemorySize))
+	case "disk":
+		if cfg.Dir == "" {
+			return nil, errors.New("cache: dir is required for disk storage")
+		}
+		store, err := openDiskStore(cfg.Dir, orDefault(cfg.MaxSize, defaultDiskSize))
+		if err != nil {
+			return nil, fmt.Errorf("cache: %w", err)
+		}
+		c.store = store
+	default:
+		return nil, fmt.Errorf("cache: unknown storage %q, expected memory or disk", cfg.Storage)
+	}
+	return c, nil
+}
+
+func orDefault(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// Config returns the configuration of the cache.
+func (c *Cache) Config() *config.Cache {
+	return c.cfg
+}
+
+// Purge removes the stored responses of an absolute URL, a trailing * removes every URL starting with the rest.
+func (c *Cache) Purge(rawURL string) int {
+	if prefix, ok := strings.CutSuffix(rawURL, "*"); ok {
+		return c.store.Delete(prefix, true)
+	}
+	return c.remove(rawURL)
+}
+
+// remove deletes the response of key and its variants, the index entry of the variants is not counted.
+func (c *Cache) remove(key string) int {
+	variants := c.store.Delete(key+variantSep, true)
+	n := c.store.Delete(key, false)
+	if variants != 0 {
+		return variants
+	}
+	return n
+}
+
+// lookup returns the stored response of key selected by req, following the index entry of responses with Vary.
+func (c *Cache) lookup(key string, req *http.Request) (*Entry, bool) {
+	entry, ok := c.store.Get(key)
+	if ok && len(entry.Variants) != 0 {
+		entry, ok = c.store.Get(variantKey(key, entry.Variants, req))
+	}
+	if !ok || !entry.matches(req) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// variantKey returns the key of the variant of url selected by the values of the Vary fields in req.
+func variantKey(url string, names []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range names {
+		b.WriteString(variantSep + name + "=" + normalize(req.Header.Values(name)))
+	}
+	return b.String()
+}
+
+// Transport returns a round tripper answering from the cache and storing the responses of next.
+func (c *Cache) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{cache: c, next: next}
+}
+
+type transport struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, status, err := t.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("Cache-Status", cacheStatus[status])
+	t.cache.logger.Debug("cache",
+		zap.String("cache", status),
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+		zap.Int("status", resp.StatusCode),
+	)
+	return resp, nil
+}
+
+func (t *transport) roundTrip(req *http.Request) (*http.Response, string, error) {
+	key := req.URL.String()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && !isSafe(req.Method) && resp.StatusCode < 400 {
+			// Unsafe methods invalidate the target (RFC 9111 section 4.4)
+			t.cache.remove(key)
+		}
+		return resp, StatusBypass, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		resp, err := t.next.RoundTrip(req)
+		return resp, StatusBypass, err
+	}
+
+	entry, ok := t.cache.lookup(key, req)
+	now := time.Now()
+	switch {
+	case ok && entry.servable(reqCC, now):
+		return t.serve(req, entry, now), StatusHit, nil
+	case reqCC.has("only-if-cached"):
+		return gatewayTimeout(req), StatusMiss, nil
+	case ok && entry.validators():
+		return t.revalidate(req, entry)
+	case ok:
+		return t.fetch(req, StatusExpired)
+	default:
+		return t.fetch(req, StatusMiss)
+	}
+}
+
+// serve answers from the entry, or with 304 when the client already has it.
+func (t *transport) serve(req *http.Request, entry *Entry, now time.Time) *http.Response {
+	resp := entry.response(req, now)
+	if entry.Status == http.StatusOK && entry.notModified(req) {
+		resp.StatusCode, resp.Status = http.StatusNotModified, "304 Not Modified"
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// revalidate sends a conditional request for a stale entry and serves the entry if the upstream confirms it.
+func (t *transport) revalidate(req *http.Request, entry *Entry) (*http.Response, string, error) {
+	conditional := req.Clone(req.Context())
+	conditional.Header.Del("If-None-Match")
+	conditional.Header.Del("If-Modified-Since")
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		conditional.Header.Set("If-Modified-Since", lm)
+	}
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(conditional)
+	if err != nil {
+		return nil, StatusExpired, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		resp.Request = req
+		return t.store(req, resp, requestTime), StatusExpired, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	now := time.Now()
+	entry.update(resp, requestTime, now)
+	t.cache.store.Put(entry)
+	return t.serve(req, entry, now), StatusRevalidated, nil
+}
+
+func (t *transport) fetch(req *http.Request, status string) (*http.Response, string, error) {
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, status, err
+	}
+	return t.store(req, resp, requestTime), status, nil
+}
+
+// store returns resp with a body that stores the response once it is read completely, if it is storable.
+func (t *transport) store(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	if !t.storable(req, resp) {
+		return resp
+	}
+	entry := &Entry{
+		Key:          req.URL.String(),
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         http.Header{},
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				entry.Vary[name] = req.Header.Values(name)
+			}
+		}
+	}
+	if entry.lifetime() <= 0 && !entry.validators() {
+		return resp
+	}
+	// Each variant gets its own key, the URL key lists the fields selecting them
+	var index *Entry
+	if len(entry.Vary) != 0 {
+		names := slices.Sorted(maps.Keys(entry.Vary))
+		index = &Entry{Key: entry.Key, Variants: names}
+		entry.Key = variantKey(entry.Key, names, req)
+	}
+	resp.Body = &captureBody{ReadCloser: resp.Body, limit: t.cache.maxObject, done: func(body []byte) {
+		entry.Body = body
+		if index != nil {
+			t.cache.store.Put(index)
+		}
+		t.cache.store.Put(entry)
+	}}
+	return resp
+}
+
+// storable implements the checks of RFC 9111 section 3 for a shared cache.
+// Responses setting cookies are only stored when marked public.
+func (t *transport) storable(req *http.Request, resp *http.Response) bool {
+	switch {
+	case req.Method != http.MethodGet, resp.StatusCode < 200,
+		resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified,
+		resp.ContentLength > t.cache.maxObject:
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" && !cc.has("public") {
+		return false
+	}
+	return true
+}
+
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// captureBody copies the body while it is read and calls done once it is read completely within limit.
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	once     sync.Once
+	done     func(body []byte)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if errors.Is(err, io.EOF) && !b.overflow {
+		b.once.Do(func() { b.done(bytes.Clone(b.buf.Bytes())) })
+	}
+	return n, err
+}
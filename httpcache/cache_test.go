@@ -0,0 +1,145 @@
+package httpcache_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/httpcache"
+)
+
+type result struct {
+	status      int
+	body        string
+	cacheStatus string
+}
+
+func newClient(t *testing.T, cfg *config.Cache) (*httpcache.Cache, func(method, url string, header http.Header) result) {
+	t.Helper()
+	c, err := httpcache.New(cfg, zap.NewNop())
+	assert.NoError(t, err)
+	rt := c.Transport(http.DefaultTransport)
+	return c, func(method, url string, header http.Header) result {
+		t.Helper()
+		req, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return result{status: resp.StatusCode, body: string(body), cacheStatus: resp.Header.Get("Cache-Status")}
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		_, _ = io.WriteString(w, strconv.Itoa(int(n)))
+	}))
+	defer backend.Close()
+	c, get := newClient(t, &config.Cache{})
+
+	first := get(http.MethodGet, backend.URL+"/fresh", nil)
+	assert.Equal(t, "junction; fwd=uri-miss", first.cacheStatus)
+	second := get(http.MethodGet, backend.URL+"/fresh", nil)
+	assert.Equal(t, result{status: 200, body: first.body, cacheStatus: "junction; hit"}, second)
+
+	// Client directives force a new response
+	noCache := get(http.MethodGet, backend.URL+"/fresh", http.Header{"Cache-Control": {"no-cache"}})
+	assert.NotEqual(t, first.body, noCache.body)
+
+	get(http.MethodGet, backend.URL+"/private", nil)
+	assert.Equal(t, "junction; fwd=uri-miss", get(http.MethodGet, backend.URL+"/private", nil).cacheStatus)
+
+	en := get(http.MethodGet, backend.URL+"/vary", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, en.body, get(http.MethodGet, backend.URL+"/vary", http.Header{"Accept-Language": {"en"}}).body)
+	assert.NotEqual(t, en.body, get(http.MethodGet, backend.URL+"/vary", http.Header{"Accept-Language": {"fa"}}).body)
+	// Variants are stored side by side
+	assert.Equal(t, "junction; hit", get(http.MethodGet, backend.URL+"/vary", http.Header{"Accept-Language": {"en"}}).cacheStatus)
+	assert.Equal(t, "junction; hit", get(http.MethodGet, backend.URL+"/vary", http.Header{"Accept-Language": {"fa"}}).cacheStatus)
+	assert.Equal(t, 2, c.Purge(backend.URL+"/vary"))
+
+	// Unsafe methods invalidate the stored response
+	get(http.MethodPost, backend.URL+"/fresh", nil)
+	assert.Equal(t, "junction; fwd=uri-miss", get(http.MethodGet, backend.URL+"/fresh", nil).cacheStatus)
+
+	assert.Equal(t, 504, get(http.MethodGet, backend.URL+"/missing", http.Header{"Cache-Control": {"only-if-cached"}}).status)
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var full, conditional atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		_, _ = io.WriteString(w, "asset")
+	}))
+	defer backend.Close()
+	_, get := newClient(t, &config.Cache{})
+
+	get(http.MethodGet, backend.URL, nil)
+	r := get(http.MethodGet, backend.URL, nil)
+	assert.Equal(t, result{status: 200, body: "asset", cacheStatus: "junction; fwd=stale; fwd-status=304"}, r)
+	assert.Equal(t, int32(1), full.Load())
+	assert.Equal(t, int32(1), conditional.Load())
+
+	// The client already has the stored version
+	r = get(http.MethodGet, backend.URL, http.Header{"If-None-Match": {`"v1"`}})
+	assert.Equal(t, 304, r.status)
+	assert.Equal(t, int32(1), full.Load())
+}
+
+func TestCachePurgeAndDiskStorage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer backend.Close()
+	dir := t.TempDir()
+	cfg := &config.Cache{Storage: "disk", Dir: dir, MaxSize: 3000}
+
+	c, get := newClient(t, cfg)
+	for _, path := range []string{"/a/1", "/a/2", "/b/1"} {
+		get(http.MethodGet, backend.URL+path, nil)
+	}
+	// Only two responses fit, the least recently used one is evicted
+	assert.Equal(t, "junction; fwd=uri-miss", get(http.MethodGet, backend.URL+"/a/1", nil).cacheStatus)
+
+	// Entries survive a restart
+	c, get = newClient(t, cfg)
+	assert.Equal(t, "junction; hit", get(http.MethodGet, backend.URL+"/a/1", nil).cacheStatus)
+
+	assert.Equal(t, 1, c.Purge(backend.URL+"/a/*"))
+	assert.Equal(t, 0, c.Purge(backend.URL+"/a/1"))
+	assert.Equal(t, 1, c.Purge(backend.URL+"/b/1"))
+
+	_, err := httpcache.New(&config.Cache{Storage: "disk"}, zap.NewNop())
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package httpcache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const entryExt = ".entry"
+
+// diskStore keeps one file per entry in a directory: the key on the first line followed by the gob encoded entry.
+// Entries left by previous runs are indexed on open, oldest first.
+type diskStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *lru
+}
+
+func openDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	s := &diskStore{dir: dir, lru: newLRU(maxSize)}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entryExt))
+	if err != nil {
+		return nil, err
+	}
+	type stored struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var found []stored
+	for _, file := range files {
+		key, info, err := readKey(file)
+		if err != nil {
+			_ = os.Remove(file)
+			continue
+		}
+		found = append(found, stored{key: key, size: info.Size(), modTime: info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b stored) int { return a.modTime.Compare(b.modTime) })
+	for _, f := range found {
+		for _, evicted := range s.lru.add(f.key, f.size) {
+			_ = os.Remove(s.path(evicted))
+		}
+	}
+	return s, nil
+}
+
+func readKey(file string) (string, os.FileInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(key, "\n"), info, nil
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+entryExt)
+}
+
+func (s *diskStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lru.items[key]; !ok {
+		return nil, false
+	}
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		s.lru.remove(key)
+		return nil, false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	stored, err := r.ReadString('\n')
+	var entry Entry
+	if err == nil && strings.TrimSuffix(stored, "\n") == key {
+		err = gob.NewDecoder(r).Decode(&entry)
+	}
+	if err != nil || entry.Key != key {
+		s.lru.remove(key)
+		_ = os.Remove(s.path(key))
+		return nil, false
+	}
+	s.lru.touch(key)
+	return &entry, true
+}
+
+func (s *diskStore) Put(entry *Entry) {
+	if strings.Contains(entry.Key, "\n") || entry.size() > s.lru.max {
+		return
+	}
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	_, err = w.WriteString(entry.Key + "\n")
+	if err == nil {
+		err = gob.NewEncoder(w).Encode(entry)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	info, statErr := tmp.Stat()
+	if closeErr := tmp.Close(); err != nil || statErr != nil || closeErr != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if os.Rename(tmp.Name(), s.path(entry.Key)) != nil {
+		return
+	}
+	for _, key := range s.lru.add(entry.Key, info.Size()) {
+		_ = os.Remove(s.path(key))
+	}
+}
+
+func (s *diskStore) Delete(key string, prefix bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.matching(key, prefix)
+	for _, k := range keys {
+		s.lru.remove(k)
+		_ = os.Remove(s.path(k))
+	}
+	return len(keys)
+}
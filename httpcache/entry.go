@@ -0,0 +1,190 @@
+package httpcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxHeuristicLifetime = 24 * time.Hour
+
+// heuristicStatus are the status codes cacheable without explicit freshness (RFC 9110 section 15.1).
+var heuristicStatus = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// notUpdated are the headers of a 304 response that do not replace the stored ones.
+var notUpdated = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding"}
+
+// Entry is a stored response.
+type Entry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	// Request header values of the fields listed by Vary
+	Vary http.Header
+	// Fields listed by Vary, only set on the index entry stored under the URL of responses with variants
+	Variants []string
+	// When the request was sent and the response received, used for the age calculation
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+func (e *Entry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, vv := range e.Header {
+		for _, v := range vv {
+			n += len(k) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+// date returns the Date of the response, or when it was received without a valid one.
+func (e *Entry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// lifetime is the freshness lifetime of the response (RFC 9111 section 4.2.1).
+func (e *Entry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && slices.Contains(heuristicStatus, e.Status) {
+		return min((e.date().Sub(lm))/10, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// age is the current age of the response (RFC 9111 section 4.2.3).
+func (e *Entry) age(now time.Time) time.Duration {
+	apparent := max(0, e.ResponseTime.Sub(e.date()))
+	var ageValue time.Duration
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// servable reports whether the entry may be sent without revalidation for a request with the given directives.
+func (e *Entry) servable(req directives, now time.Time) bool {
+	resp := parseCacheControl(e.Header)
+	if resp.has("no-cache") || req.has("no-cache") {
+		return false
+	}
+	age, lifetime := e.age(now), e.lifetime()
+	if maxAge, ok := req.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := req.duration("min-fresh"); ok {
+		lifetime -= minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+	if !req.has("max-stale") || resp.has("must-revalidate") || resp.has("proxy-revalidate") || resp.has("s-maxage") {
+		return false
+	}
+	maxStale, ok := req.duration("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+// matches reports whether the request selects this variant.
+func (e *Entry) matches(req *http.Request) bool {
+	for name, stored := range e.Vary {
+		if normalize(req.Header.Values(name)) != normalize(stored) {
+			return false
+		}
+	}
+	return true
+}
+
+// validators reports whether the entry can be revalidated with a conditional request.
+func (e *Entry) validators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// update merges the headers of a 304 response into the entry (RFC 9111 section 4.3.4).
+func (e *Entry) update(resp *http.Response, requestTime, responseTime time.Time) {
+	for k, vv := range resp.Header {
+		if slices.Contains(notUpdated, k) {
+			continue
+		}
+		e.Header[k] = slices.Clone(vv)
+	}
+	e.RequestTime, e.ResponseTime = requestTime, responseTime
+}
+
+// response builds the response sent for the entry, HEAD requests get no body.
+func (e *Entry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+	return resp
+}
+
+// notModified reports whether the conditional headers of the client request match the entry.
+func (e *Entry) notModified(req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for candidate := range strings.SplitSeq(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(since)
+}
+
+func normalize(values []string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		for part := range strings.SplitSeq(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,128 @@
+package httpcache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// Storage keeps entries by key within a size bound, least recently used entries are evicted first.
+type Storage interface {
+	Get(key string) (*Entry, bool)
+	Put(entry *Entry)
+	// Delete removes the entries whose key is key, or starts with it when prefix is set, and returns their count
+	Delete(key string, prefix bool) int
+}
+
+// lru tracks the size and recency of stored keys.
+type lru struct {
+	max   int64
+	size  int64
+	order *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{max: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) touch(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+// add records key and returns the keys evicted to make room for it.
+func (l *lru) add(key string, size int64) []string {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size})
+	l.size += size
+	var evicted []string
+	for l.size > l.max {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	return true
+}
+
+// matching returns the stored keys equal to key, or starting with it when prefix is set.
+func (l *lru) matching(key string, prefix bool) []string {
+	if !prefix {
+		if _, ok := l.items[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	var keys []string
+	for k := range l.items {
+		if strings.HasPrefix(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// memoryStore keeps entries in memory.
+type memoryStore struct {
+	mu      sync.Mutex
+	lru     *lru
+	entries map[string]*Entry
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{lru: newLRU(maxSize), entries: make(map[string]*Entry)}
+}
+
+func (s *memoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.touch(key)
+	// Callers update entries on revalidation
+	clone := *e
+	clone.Header = e.Header.Clone()
+	return &clone, true
+}
+
+func (s *memoryStore) Put(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.size() > s.lru.max {
+		return
+	}
+	s.entries[entry.Key] = entry
+	for _, key := range s.lru.add(entry.Key, entry.size()) {
+		delete(s.entries, key)
+	}
+}
+
+func (s *memoryStore) Delete(key string, prefix bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.lru.matching(key, prefix)
+	for _, k := range keys {
+		s.lru.remove(k)
+		delete(s.entries, k)
+	}
+	return len(keys)
+}
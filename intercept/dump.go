@@ -0,0 +1,202 @@
+package intercept
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSONL = "jsonl"
+	FormatHAR   = "har"
+
+	// harFlushDelay batches HAR rewrites, the whole document is written on every flush.
+	harFlushDelay = time.Second
+	// maxHAREntries bounds the HAR document, the oldest entries are dropped.
+	maxHAREntries = 10000
+)
+
+// Dumper writes intercepted exchanges as HAR entries, either one per line (jsonl) or as a HAR document.
+type Dumper struct {
+	mu      sync.Mutex
+	path    string
+	format  string
+	file    *os.File // jsonl
+	entries []*Entry // har
+	timer   *time.Timer
+}
+
+// NewDumper opens the dump file, nil is returned when path is empty.
+func NewDumper(path, format string) (*Dumper, error) {
+	if path == "" {
+		return nil, nil
+	}
+	d := &Dumper{path: path, format: format}
+	switch format {
+	case "", FormatJSONL:
+		d.format = FormatJSONL
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		d.file = f
+	case FormatHAR:
+	default:
+		return nil, fmt.Errorf("unknown dump format %q, expected jsonl or har", format)
+	}
+	return d, nil
+}
+
+// Record writes the entry, HAR documents are flushed shortly after.
+func (d *Dumper) Record(e *Entry) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.format == FormatJSONL {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = d.file.Write(append(line, '\n'))
+		return err
+	}
+
+	if len(d.entries) >= maxHAREntries {
+		d.entries = d.entries[1:]
+	}
+	d.entries = append(d.entries, e)
+	if d.timer == nil {
+		d.timer = time.AfterFunc(harFlushDelay, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.timer = nil
+			_ = d.flushHAR()
+		})
+	}
+	return nil
+}
+
+// Close flushes pending entries and closes the dump file.
+func (d *Dumper) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file != nil {
+		return d.file.Close()
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	return d.flushHAR()
+}
+
+// flushHAR atomically rewrites the HAR document, d.mu must be held.
+func (d *Dumper) flushHAR() error {
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "junction", Version: "1"},
+		Entries: d.entries,
+	}}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []*Entry   `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is a HAR 1.2 entry of a single exchange.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"` // milliseconds
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+	ServerIPAddress string    `json:"serverIPAddress,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	HTTPVersion string    `json:"httpVersion"`
+	Cookies     []NameVal `json:"cookies"`
+	Headers     []NameVal `json:"headers"`
+	QueryString []NameVal `json:"queryString"`
+	PostData    *PostData `json:"postData,omitempty"`
+	HeadersSize int       `json:"headersSize"`
+	BodySize    int64     `json:"bodySize"`
+}
+
+type Response struct {
+	Status      int       `json:"status"`
+	StatusText  string    `json:"statusText"`
+	HTTPVersion string    `json:"httpVersion"`
+	Cookies     []NameVal `json:"cookies"`
+	Headers     []NameVal `json:"headers"`
+	Content     Content   `json:"content"`
+	RedirectURL string    `json:"redirectURL"`
+	HeadersSize int       `json:"headersSize"`
+	BodySize    int64     `json:"bodySize"`
+}
+
+type NameVal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Content struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
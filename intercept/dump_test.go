@@ -0,0 +1,60 @@
+package intercept_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/intercept"
+)
+
+func TestDumperFormats(t *testing.T) {
+	dir := t.TempDir()
+	entry := &intercept.Entry{
+		Request:  intercept.Request{Method: "GET", URL: "https://api.example.com/v1/"},
+		Response: intercept.Response{Status: 200},
+	}
+
+	jsonl := filepath.Join(dir, "dump.jsonl")
+	d, err := intercept.NewDumper(jsonl, "")
+	assert.NoError(t, err)
+	assert.NoError(t, d.Record(entry))
+	assert.NoError(t, d.Record(entry))
+	assert.NoError(t, d.Close())
+	data, err := os.ReadFile(jsonl)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+	var decoded intercept.Entry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &decoded))
+	assert.Equal(t, entry.Request.URL, decoded.Request.URL)
+
+	har := filepath.Join(dir, "dump.har")
+	d, err = intercept.NewDumper(har, intercept.FormatHAR)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Record(entry))
+	assert.NoError(t, d.Close())
+	data, err = os.ReadFile(har)
+	assert.NoError(t, err)
+	var doc struct {
+		Log struct {
+			Version string            `json:"version"`
+			Entries []intercept.Entry `json:"entries"`
+		} `json:"log"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "1.2", doc.Log.Version)
+	assert.Equal(t, 1, len(doc.Log.Entries))
+
+	_, err = intercept.NewDumper(filepath.Join(dir, "dump.txt"), "txt")
+	assert.Error(t, err)
+
+	d, err = intercept.NewDumper("", "")
+	assert.NoError(t, err)
+	assert.NoError(t, d.Record(entry))
+	assert.NoError(t, d.Close())
+}
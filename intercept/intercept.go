@@ -0,0 +1,441 @@
+package intercept
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/crypto/certs"
+)
+
+const (
+	defaultMaxBody   = 64 << 10
+	handshakeTimeout = 10 * time.Second
+	// maxRewriteBody bounds response bodies loaded in memory for replace_body.
+	maxRewriteBody = 16 << 20
+)
+
+var ErrNotAllowed = errors.New("host is not allow-listed for interception")
+
+type exchangeKey struct{}
+
+// exchange holds the state of a single intercepted request.
+type exchange struct {
+	started  time.Time
+	received time.Time
+	proto    string
+	request  *capture
+}
+
+// Interceptor decrypts TLS connections of allow-listed hosts with certificates minted by a CA,
+// applies rewrite rules and dumps the exchanges before forwarding them upstream over TLS.
+type Interceptor struct {
+	cfg     *config.Intercept
+	ca      *certs.CA
+	dumper  *Dumper
+	maxBody int64
+	logger  *zap.Logger
+}
+
+// New validates cfg and loads (or creates) its CA. Interception is refused without an allow list of hosts.
+func New(cfg *config.Intercept, logger *zap.Logger) (*Interceptor, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, errors.New("intercept: hosts is required, interception is strictly allow-listed")
+	}
+	if cfg.CA == nil || cfg.CA.Cert == "" || cfg.CA.Key == "" {
+		return nil, errors.New("intercept: ca cert and key are required")
+	}
+	for _, r := range cfg.Rewrites {
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("intercept: %w", err)
+		}
+	}
+	ca, err := certs.LoadOrCreateCA(cfg.CA.Cert, cfg.CA.Key)
+	if err != nil {
+		return nil, fmt.Errorf("intercept: %w", err)
+	}
+	dumper, err := NewDumper(cfg.Dump, cfg.DumpFormat)
+	if err != nil {
+		return nil, fmt.Errorf("intercept: %w", err)
+	}
+	maxBody := cfg.MaxBody
+	if maxBody <= 0 {
+		maxBody = defaultMaxBody
+	}
+	return &Interceptor{cfg: cfg, ca: ca, dumper: dumper, maxBody: maxBody, logger: logger}, nil
+}
+
+// Matches reports whether the host is allow-listed for interception.
+func (i *Interceptor) Matches(host string) bool {
+	for _, m := range i.cfg.Hosts {
+		if m.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close flushes and closes the dump file.
+func (i *Interceptor) Close() error {
+	return i.dumper.Close()
+}
+
+// Serve completes the TLS handshake of client as host and forwards its HTTP requests to host:port over TLS,
+// upstream connections are made with dial. It returns once the client connection is closed or ctx is canceled.
+func (i *Interceptor) Serve(ctx context.Context, client net.Conn, host, port string, dial func(network, address string) (net.Conn, error)) error {
+	if !i.Matches(host) {
+		return ErrNotAllowed
+	}
+	leaf, err := i.ca.Certificate(host)
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Server(client, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*leaf},
+		NextProtos:   []string{"http/1.1"},
+	})
+	hsCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	err = tlsConn.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		_ = client.Close()
+		return fmt.Errorf("client handshake: %w", err)
+	}
+
+	logger := i.logger.With(zap.String("host", host))
+	upstream := net.JoinHostPort(host, port)
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return dial("tcp", upstream)
+		},
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ServerName:         host,
+			InsecureSkipVerify: i.cfg.SkipVerify, //nolint:gosec // opt-in for self-signed upstreams
+		},
+		ForceAttemptHTTP2:  true,
+		DisableCompression: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	authority := host
+	if port != "443" {
+		authority = upstream
+	}
+	conn := &notifyConn{Conn: tlsConn, closed: make(chan struct{})}
+	srv := &http.Server{
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		Handler:           i.handler(i.reverseProxy(authority, transport, logger)),
+		ErrorLog:          zap.NewStdLog(logger),
+	}
+	go func() { _ = srv.Serve(&connListener{conn: conn, closed: make(chan struct{})}) }()
+	select {
+	case <-conn.closed:
+	case <-ctx.Done():
+	}
+	return srv.Close()
+}
+
+func (i *Interceptor) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ex := &exchange{started: time.Now(), proto: r.Proto}
+		if i.dumper != nil && r.Body != nil && r.Body != http.NoBody {
+			ex.request = &capture{ReadCloser: r.Body, max: i.maxBody}
+			r.Body = ex.request
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)))
+	})
+}
+
+func (i *Interceptor) reverseProxy(authority string, transport http.RoundTripper, logger *zap.Logger) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = authority
+			pr.Out.Host = pr.In.Host
+			if i.dumper != nil || i.replacesBody() {
+				// Keep bodies readable for dumps and replacements
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+			for _, rw := range i.rewrites(pr.In) {
+				rw.RequestHeaders.Apply(pr.Out.Header)
+				if path := rw.RewritePath(pr.Out.URL.Path); path != pr.Out.URL.Path {
+					pr.Out.URL.Path, pr.Out.URL.RawPath = path, ""
+				}
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			return i.modifyResponse(resp, logger)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("intercepted request failed", zap.String("url", r.URL.String()), zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+func (i *Interceptor) modifyResponse(resp *http.Response, logger *zap.Logger) error {
+	ex, _ := resp.Request.Context().Value(exchangeKey{}).(*exchange)
+	if ex != nil {
+		ex.received = time.Now()
+	}
+	for _, rw := range i.rewrites(resp.Request) {
+		rw.ResponseHeaders.Apply(resp.Header)
+		if replacer := rw.BodyReplacer(); replacer != nil && isPlainText(resp) {
+			if err := replaceBody(resp, replacer); err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Info("intercepted exchange",
+		zap.String("method", resp.Request.Method),
+		zap.String("url", resp.Request.URL.String()),
+		zap.Int("status", resp.StatusCode),
+	)
+	if i.dumper == nil || ex == nil {
+		return nil
+	}
+	body := &capture{ReadCloser: resp.Body, max: i.maxBody}
+	body.done = func() {
+		if err := i.dumper.Record(newEntry(ex, resp, body)); err != nil {
+			logger.Warn("failed to dump exchange", zap.Error(err))
+		}
+	}
+	resp.Body = body
+	return nil
+}
+
+func (i *Interceptor) rewrites(r *http.Request) []*config.Rewrite {
+	var matched []*config.Rewrite
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, rw := range i.cfg.Rewrites {
+		if rw != nil && rw.Matches(host, r.URL.Path) {
+			matched = append(matched, rw)
+		}
+	}
+	return matched
+}
+
+func (i *Interceptor) replacesBody() bool {
+	for _, rw := range i.cfg.Rewrites {
+		if rw != nil && len(rw.ReplaceBody) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isPlainText(resp *http.Response) bool {
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/javascript"
+}
+
+func replaceBody(resp *http.Response, replacer *strings.Replacer) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxRewriteBody {
+		return fmt.Errorf("response body exceeds %d bytes, refusing to rewrite", maxRewriteBody)
+	}
+	replaced := replacer.Replace(string(data))
+	resp.Body = io.NopCloser(strings.NewReader(replaced))
+	resp.ContentLength = int64(len(replaced))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(replaced)))
+	return nil
+}
+
+// newEntry builds the HAR entry of an exchange once its response body is consumed.
+func newEntry(ex *exchange, resp *http.Response, body *capture) *Entry {
+	now := time.Now()
+	req := resp.Request
+	e := &Entry{
+		StartedDateTime: ex.started,
+		Time:            millis(now.Sub(ex.started)),
+		Request: Request{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: ex.proto,
+			Cookies:     cookieValues(req.Cookies()),
+			Headers:     headerValues(req.Header),
+			QueryString: queryValues(req),
+			HeadersSize: -1,
+		},
+		Response: Response{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     cookieValues(resp.Cookies()),
+			Headers:     headerValues(resp.Header),
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    body.size,
+			Content:     Content{Size: body.size, MimeType: resp.Header.Get("Content-Type")},
+		},
+		Timings: Timings{
+			Wait:    millis(ex.received.Sub(ex.started)),
+			Receive: millis(now.Sub(ex.received)),
+		},
+	}
+	e.Response.Content.Text, e.Response.Content.Encoding, e.Response.Content.Comment = bodyText(body)
+	if ex.request != nil {
+		e.Request.BodySize = ex.request.size
+		post := &PostData{MimeType: req.Header.Get("Content-Type")}
+		var encoding string
+		post.Text, encoding, post.Comment = bodyText(ex.request)
+		if encoding != "" {
+			post.Comment = strings.TrimSpace("base64 encoded " + post.Comment)
+		}
+		e.Request.PostData = post
+	}
+	return e
+}
+
+func bodyText(c *capture) (string, string, string) {
+	var comment string
+	if c.truncated() {
+		comment = fmt.Sprintf("truncated to %d bytes", c.buf.Len())
+	}
+	if utf8.Valid(c.buf.Bytes()) {
+		return c.buf.String(), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(c.buf.Bytes()), "base64", comment
+}
+
+func headerValues(h http.Header) []NameVal {
+	values := make([]NameVal, 0, len(h))
+	for k, vv := range h {
+		for _, v := range vv {
+			values = append(values, NameVal{Name: k, Value: v})
+		}
+	}
+	return values
+}
+
+func cookieValues(cookies []*http.Cookie) []NameVal {
+	values := make([]NameVal, len(cookies))
+	for i, c := range cookies {
+		values[i] = NameVal{Name: c.Name, Value: c.Value}
+	}
+	return values
+}
+
+func queryValues(r *http.Request) []NameVal {
+	values := []NameVal{}
+	for k, vv := range r.URL.Query() {
+		for _, v := range vv {
+			values = append(values, NameVal{Name: k, Value: v})
+		}
+	}
+	return values
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// capture keeps the first max bytes read through it, done is called once the body is consumed or closed.
+type capture struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	max  int64
+	size int64
+	done func()
+	once sync.Once
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	if keep := c.max - int64(c.buf.Len()); keep > 0 {
+		c.buf.Write(p[:min(int64(n), keep)])
+	}
+	if errors.Is(err, io.EOF) {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *capture) Close() error {
+	err := c.ReadCloser.Close()
+	c.finish()
+	return err
+}
+
+func (c *capture) finish() {
+	if c.done != nil {
+		c.once.Do(c.done)
+	}
+}
+
+func (c *capture) truncated() bool {
+	return c.size > int64(c.buf.Len())
+}
+
+// notifyConn signals closed once the connection is closed, by the server or after a hijack.
+type notifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener serves a single connection.
+type connListener struct {
+	conn   net.Conn
+	accept sync.Once
+	close  sync.Once
+	closed chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.accept.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.close.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -1,11 +1,15 @@
 package proxy
 
 import (
+	"errors"
 	"net/url"
 
 	"golang.org/x/net/proxy"
 )
 
+// ErrProxyAuth is wrapped by dial errors of proxies that rejected the configured credentials.
+var ErrProxyAuth = errors.New("proxy authentication failed")
+
 type generator func(*url.URL, proxy.Dialer) (proxy.Dialer, error)
 
 var generators []generator
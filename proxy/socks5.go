@@ -1,7 +1,10 @@
 package proxy
 
 import (
+	"fmt"
+	"net"
 	"net/url"
+	"strings"
 
 	"golang.org/x/net/proxy"
 )
@@ -14,5 +17,23 @@ func socks5Dialer(url *url.URL, dialer proxy.Dialer) (proxy.Dialer, error) {
 	if url.Scheme != "socks5" && url.Scheme != "socks5h" {
 		return nil, nil
 	}
-	return proxy.FromURL(url, dialer)
+	d, err := proxy.FromURL(url, dialer)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5ProxyDialer{dialer: d}, nil
+}
+
+// socks5ProxyDialer marks the errors of rejected credentials with ErrProxyAuth.
+type socks5ProxyDialer struct {
+	dialer proxy.Dialer
+}
+
+func (s *socks5ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := s.dialer.Dial(network, address)
+	// x/net reports the method negotiation and username/password failures as plain errors
+	if err != nil && strings.Contains(err.Error(), "authentication") {
+		return nil, fmt.Errorf("%w: %w", ErrProxyAuth, err)
+	}
+	return conn, err
 }
@@ -85,6 +85,9 @@ func (s *sshProxyDialer) Dial(network, address string) (net.Conn, error) {
 	conn, chans, reqs, err := gossh.NewClientConn(rawConn, s.addr, s.config)
 	if err != nil {
 		rawConn.Close()
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("SSH handshake failed: %w: %w", ErrProxyAuth, err)
+		}
 		return nil, fmt.Errorf("SSH handshake failed: %w", err)
 	}
 
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package quota
+
+// lockFile is a no-op where flock is not available, a reset running next to the server may be
+// overwritten by its next flush there.
+func lockFile(string) (func(), error) {
+	return func() {}, nil
+}
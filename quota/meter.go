@@ -0,0 +1,145 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/utils"
+)
+
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+const throttleBurst = 16 * 1024
+
+var (
+	throttleMu sync.Mutex
+	throttles  = make(map[string]*utils.Bucket)
+)
+
+// throttleBucket returns the bucket shared by the throttled clients of the quota.
+func throttleBucket(q *config.Quota) *utils.Bucket {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+	b, ok := throttles[q.Name]
+	if !ok {
+		b = utils.NewBucket(float64(q.Throttle), max(int(q.Throttle), throttleBurst))
+		throttles[q.Name] = b
+		return b
+	}
+	b.SetRate(float64(q.Throttle), max(int(q.Throttle), throttleBurst))
+	return b
+}
+
+// Meter accounts traffic of a single connection to its quotas.
+type Meter struct {
+	ctx    context.Context
+	store  *Store
+	quotas []*config.Quota
+}
+
+// NewMeter returns a meter for the quotas applying to the client, nil if there is none.
+func NewMeter(ctx context.Context, store *Store, quotas []*config.Quota, client net.IP) *Meter {
+	if store == nil || len(quotas) == 0 {
+		return nil
+	}
+	m := &Meter{ctx: ctx, store: store}
+	for _, q := range quotas {
+		if q.Limit > 0 && q.Applies(client) {
+			m.quotas = append(m.quotas, q)
+		}
+	}
+	if len(m.quotas) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Check returns ErrQuotaExceeded if a blocking quota is already exhausted.
+func (m *Meter) Check() error {
+	now := time.Now()
+	for _, q := range m.quotas {
+		if q.Action != config.QuotaThrottle && m.store.Used(q.Name, q.PeriodKey(now)) >= q.Limit {
+			return ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// Charge accounts n bytes, it blocks while a throttled quota is exhausted
+// and returns ErrQuotaExceeded once a blocking quota is exhausted.
+func (m *Meter) Charge(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	var exceeded error
+	for _, q := range m.quotas {
+		if m.store.Add(q.Name, q.PeriodKey(now), int64(n)) <= q.Limit {
+			continue
+		}
+		if q.Action == config.QuotaThrottle {
+			if err := throttleBucket(q).Wait(m.ctx, n); err != nil {
+				return err
+			}
+			continue
+		}
+		exceeded = ErrQuotaExceeded
+	}
+	return exceeded
+}
+
+// Reader charges everything read from r.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meteredReader{r: r, meter: m}
+}
+
+type meteredReader struct {
+	r     io.Reader
+	meter *Meter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if cErr := r.meter.Charge(n); cErr != nil {
+		return n, cErr
+	}
+	return n, err
+}
+
+// Conn charges traffic of both directions of the connection.
+type Conn struct {
+	net.Conn
+	meter *Meter
+}
+
+// WrapConn charges traffic of conn to the meter, conn is returned as is if the meter is nil.
+func WrapConn(conn net.Conn, m *Meter) net.Conn {
+	if m == nil {
+		return conn
+	}
+	return &Conn{Conn: conn, meter: m}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if cErr := c.meter.Charge(n); cErr != nil {
+		return n, cErr
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if cErr := c.meter.Charge(n); cErr != nil {
+		return n, cErr
+	}
+	return n, err
+}
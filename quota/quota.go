@@ -0,0 +1,99 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/fmotalleb/go-tools/log"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+const flushInterval = 30 * time.Second
+
+// Quota names are keys of the store file and arguments of the CLI.
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var (
+	currentMu sync.Mutex
+	current   *Store
+	stopFlush context.CancelFunc
+)
+
+// Setup opens the store at path and flushes it periodically until Close is called.
+// The open store is kept if the path did not change, so config reloads do not lose accounted traffic.
+func Setup(ctx context.Context, path string) (*Store, error) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current != nil && current.path == path {
+		return current, nil
+	}
+	closeCurrent(ctx)
+
+	store, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	flushCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go flushLoop(flushCtx, store)
+	current = store
+	stopFlush = cancel
+	return store, nil
+}
+
+// Validate reports the first quota of the entries with an invalid name.
+func Validate(entries []config.EntryPoint) error {
+	for _, e := range entries {
+		for _, q := range e.Quotas {
+			if q != nil && !validName.MatchString(q.Name) {
+				return fmt.Errorf("quota: invalid name %q, expected up to 64 letters, digits, '.', '_' or '-'", q.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Current returns the store opened by Setup, nil if there is none.
+func Current() *Store {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	return current
+}
+
+// Close stops the periodic flush and flushes the open store one last time.
+func Close(ctx context.Context) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	closeCurrent(ctx)
+}
+
+func closeCurrent(ctx context.Context) {
+	if current == nil {
+		return
+	}
+	stopFlush()
+	if err := current.Flush(); err != nil {
+		log.Of(ctx).Named("quota").Error("failed to flush quota store", zap.Error(err))
+	}
+	current = nil
+}
+
+func flushLoop(ctx context.Context, store *Store) {
+	logger := log.Of(ctx).Named("quota")
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.Flush(); err != nil {
+				logger.Error("failed to flush quota store", zap.Error(err))
+			}
+		}
+	}
+}
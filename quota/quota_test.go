@@ -0,0 +1,20 @@
+package quota_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/quota"
+)
+
+func TestValidate(t *testing.T) {
+	entries := func(name string) []config.EntryPoint {
+		return []config.EntryPoint{{Quotas: []*config.Quota{{Name: name}}}}
+	}
+	assert.NoError(t, quota.Validate(entries("team-a.monthly_1")))
+	for _, name := range []string{"", " team", "team a", "-team", "team\n"} {
+		assert.Error(t, quota.Validate(entries(name)), name)
+	}
+}
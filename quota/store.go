@@ -0,0 +1,220 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic accounted to a quota in its current period.
+type Usage struct {
+	Period  string    `json:"period"`
+	Bytes   int64     `json:"bytes"`
+	Updated time.Time `json:"updated"`
+}
+
+type usageKey struct {
+	name   string
+	period string
+}
+
+// Store keeps quota usage in memory and persists it into a JSON file.
+// Only the traffic accounted since the last flush is merged into the file,
+// so usage reset by the CLI while the server is running is not overwritten.
+// Both hold a lock on the file next to it (path + ".lock") while reading and writing.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	usage   map[string]Usage // as of the last flush
+	pending map[usageKey]int64
+}
+
+// Open loads the store at path, an empty path keeps usage in memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		pending: make(map[usageKey]int64),
+	}
+	usage, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.usage = usage
+	return s, nil
+}
+
+// Add accounts n bytes to the quota and returns its usage in the period.
+func (s *Store) Add(name, period string, n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := usageKey{name: name, period: period}
+	s.pending[key] += n
+	return s.used(key)
+}
+
+// Used returns the usage of the quota in the period.
+func (s *Store) Used(name, period string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used(usageKey{name: name, period: period})
+}
+
+func (s *Store) used(key usageKey) int64 {
+	total := s.pending[key]
+	if u, ok := s.usage[key.name]; ok && u.Period == key.period {
+		total += u.Bytes
+	}
+	return total
+}
+
+// Snapshot returns the persisted usage merged with traffic not flushed yet.
+func (s *Store) Snapshot() map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]Usage, len(s.usage))
+	for name, u := range s.usage {
+		result[name] = u
+	}
+	merge(result, s.pending, time.Now())
+	return result
+}
+
+// Reset clears the usage of the given quotas, or of every quota if none is given.
+func (s *Store) Reset(names ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	usage, err := s.read()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		usage = make(map[string]Usage)
+		s.pending = make(map[usageKey]int64)
+	}
+	for _, name := range names {
+		delete(usage, name)
+		for key := range s.pending {
+			if key.name == name {
+				delete(s.pending, key)
+			}
+		}
+	}
+	if err = s.write(usage); err != nil {
+		return err
+	}
+	s.usage = usage
+	return nil
+}
+
+// Flush merges the traffic accounted since the last flush into the file,
+// changes made to the file by other processes (e.g. reset) are picked up as well.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		// Memory only, keep everything in pending
+		return nil
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	usage, err := s.read()
+	if err != nil {
+		return err
+	}
+	if len(s.pending) == 0 {
+		s.usage = usage
+		return nil
+	}
+	merge(usage, s.pending, time.Now())
+	if err = s.write(usage); err != nil {
+		return err
+	}
+	s.usage = usage
+	s.pending = make(map[usageKey]int64)
+	return nil
+}
+
+// merge adds pending traffic into usage, traffic of a newer period replaces the older one.
+func merge(usage map[string]Usage, pending map[usageKey]int64, now time.Time) {
+	for key, n := range pending {
+		u := usage[key.name]
+		switch {
+		case u.Period == key.period:
+		case u.Period < key.period:
+			u = Usage{Period: key.period}
+		default:
+			// Traffic of a past period
+			continue
+		}
+		u.Bytes += n
+		u.Updated = now
+		usage[key.name] = u
+	}
+}
+
+// lock serializes the read-merge-write cycles of the processes sharing the file.
+func (s *Store) lock() (func(), error) {
+	if s.path == "" {
+		return func() {}, nil
+	}
+	return lockFile(s.path + ".lock")
+}
+
+func (s *Store) read() (map[string]Usage, error) {
+	usage := make(map[string]Usage)
+	if s.path == "" {
+		return usage, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read quota store: %w", err)
+	}
+	if len(data) == 0 {
+		return usage, nil
+	}
+	if err = json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("decode quota store: %w", err)
+	}
+	return usage, nil
+}
+
+// write replaces the file atomically.
+func (s *Store) write(usage map[string]Usage) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write quota store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write quota store: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("write quota store: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,65 @@
+package quota_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/fmotalleb/junction/quota"
+)
+
+func TestStoreFlushKeepsExternalReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	server, err := quota.Open(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(100), server.Add("team", "2025-06", 100))
+	assert.NoError(t, server.Flush())
+
+	// CLI resets the usage while the server is running
+	cli, err := quota.Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), cli.Used("team", "2025-06"))
+	assert.NoError(t, cli.Reset("team"))
+
+	server.Add("team", "2025-06", 10)
+	assert.NoError(t, server.Flush())
+	assert.Equal(t, int64(10), server.Used("team", "2025-06"))
+}
+
+func TestStoreConcurrentFlushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	// Stores of separate processes flushing at the same time
+	var wg sync.WaitGroup
+	for range 4 {
+		store, err := quota.Open(path)
+		assert.NoError(t, err)
+		wg.Go(func() {
+			for range 25 {
+				store.Add("team", "2025-06", 1)
+				assert.NoError(t, store.Flush())
+			}
+		})
+	}
+	wg.Wait()
+
+	store, err := quota.Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), store.Used("team", "2025-06"))
+}
+
+func TestStoreNewPeriodRestartsUsage(t *testing.T) {
+	store, err := quota.Open(filepath.Join(t.TempDir(), "usage.json"))
+	assert.NoError(t, err)
+
+	store.Add("team", "2025-06", 100)
+	assert.NoError(t, store.Flush())
+	assert.Equal(t, int64(5), store.Add("team", "2025-07", 5))
+	assert.NoError(t, store.Flush())
+
+	usage := store.Snapshot()["team"]
+	assert.Equal(t, "2025-07", usage.Period)
+	assert.Equal(t, int64(5), usage.Bytes)
+}
@@ -0,0 +1,181 @@
+package router
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fmotalleb/go-tools/matcher"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/crypto/htpasswd"
+)
+
+const defaultAuthRealm = "junction"
+
+var (
+	authMu         sync.Mutex
+	authenticators = map[*config.ProxyAuth]*authenticator{}
+)
+
+func init() {
+	registerReset(func() {
+		authMu.Lock()
+		defer authMu.Unlock()
+		authenticators = make(map[*config.ProxyAuth]*authenticator)
+	})
+}
+
+// authenticator checks the Proxy-Authorization credentials of an entrypoint.
+type authenticator struct {
+	realm string
+	users map[string]*authUser
+	// Digests of credentials that passed verification, so bcrypt runs once per client and not per request
+	verified sync.Map
+}
+
+type authUser struct {
+	hash  string
+	allow []*matcher.Matcher
+}
+
+// setupAuth loads the users of entry, the htpasswd file is read once per config load.
+func setupAuth(entry config.EntryPoint) error {
+	if entry.Auth == nil {
+		return nil
+	}
+	authMu.Lock()
+	defer authMu.Unlock()
+	if authenticators[entry.Auth] != nil {
+		return nil
+	}
+	a, err := newAuthenticator(entry.Auth)
+	if err != nil {
+		return fmt.Errorf("%s: auth: %w", entry.Routing, err)
+	}
+	authenticators[entry.Auth] = a
+	return nil
+}
+
+func newAuthenticator(cfg *config.ProxyAuth) (*authenticator, error) {
+	a := &authenticator{
+		realm: cmp.Or(cfg.Realm, defaultAuthRealm),
+		users: make(map[string]*authUser),
+	}
+	if cfg.HTPasswd != "" {
+		users, err := htpasswd.Load(cfg.HTPasswd)
+		if err != nil {
+			return nil, err
+		}
+		for name, hash := range users {
+			a.users[name] = &authUser{hash: hash}
+		}
+	}
+	for _, u := range cfg.Users {
+		if u == nil || u.Name == "" {
+			continue
+		}
+		user, ok := a.users[u.Name]
+		if !ok {
+			if u.Password == "" {
+				return nil, fmt.Errorf("user %q has no password and is not in the htpasswd file", u.Name)
+			}
+			user = &authUser{}
+			a.users[u.Name] = user
+		}
+		if u.Password != "" {
+			user.hash = u.Password
+		}
+		user.allow = u.AllowList
+	}
+	if len(a.users) == 0 {
+		return nil, errors.New("no users defined")
+	}
+	return a, nil
+}
+
+func authFor(entry config.EntryPoint) *authenticator {
+	if entry.Auth == nil {
+		return nil
+	}
+	authMu.Lock()
+	defer authMu.Unlock()
+	return authenticators[entry.Auth]
+}
+
+// authenticate returns the user of the Basic Proxy-Authorization credentials of r.
+func (a *authenticator) authenticate(r *http.Request) (string, *authUser, bool) {
+	scheme, encoded, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, false
+	}
+	name, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", nil, false
+	}
+	user, ok := a.users[name]
+	if !ok {
+		return name, nil, false
+	}
+	digest := sha256.Sum256([]byte(user.hash + "\x00" + password))
+	if _, ok := a.verified.Load(digest); ok {
+		return name, user, true
+	}
+	if !htpasswd.Verify(user.hash, password) {
+		return name, nil, false
+	}
+	a.verified.Store(digest, struct{}{})
+	return name, user, true
+}
+
+// challenge answers with 407 and the Basic challenge of the realm.
+func (a *authenticator) challenge(w http.ResponseWriter, r *http.Request, entry config.EntryPoint) {
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm))
+	writeError(w, r, entry, authRequired)
+}
+
+// allowed reports whether the user may reach host, users without an allow list reach every host.
+func (u *authUser) allowed(host string) bool {
+	if len(u.allow) == 0 {
+		return true
+	}
+	for _, m := range u.allow {
+		if m.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the proxy credentials of the client against entry, and the allow list of the user against
+// targetHost unless it is empty (fallback backends). The returned handler logs the user with every message of the request.
+func (h *httpProxyHandler) authorize(w http.ResponseWriter, r *http.Request, entry config.EntryPoint, targetHost string) (*httpProxyHandler, bool) {
+	a := authFor(entry)
+	if a == nil {
+		return h, true
+	}
+	name, user, ok := a.authenticate(r)
+	if !ok {
+		h.logger.Debug("proxy authentication failed", zap.String("client", r.RemoteAddr), zap.String("user", name))
+		a.challenge(w, r, entry)
+		return nil, false
+	}
+	if targetHost != "" && !user.allowed(hostOnly(targetHost)) {
+		h.logger.Warn("hostname rejected for user", zap.String("user", name), zap.String("hostname", targetHost))
+		writeError(w, r, entry, blockedUserHost)
+		return nil, false
+	}
+	scoped := *h
+	scoped.logger = h.logger.With(zap.String("user", name))
+	return &scoped, true
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestProxyAuthorization(t *testing.T) {
+	htpasswdFile := filepath.Join(t.TempDir(), ".htpasswd")
+	// bob:secret
+	if err := os.WriteFile(htpasswdFile, []byte("bob:$apr1$r31Ywh5q$wpljihABvRuxc9v6ZuAu21\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entry := config.EntryPoint{Auth: &config.ProxyAuth{
+		Realm:    "office",
+		HTPasswd: htpasswdFile,
+		Users:    []*config.ProxyUser{{Name: "alice", Password: "wonderland"}},
+	}}
+	if err := setupAuth(entry); err != nil {
+		t.Fatal(err)
+	}
+	defer Reset()
+	h := &httpProxyHandler{logger: zap.NewNop()}
+
+	tests := []struct {
+		name, user, password string
+		status               int
+	}{
+		{"missing credentials", "", "", http.StatusProxyAuthRequired},
+		{"wrong password", "alice", "secret", http.StatusProxyAuthRequired},
+		{"unknown user", "eve", "secret", http.StatusProxyAuthRequired},
+		{"config user", "alice", "wonderland", http.StatusOK},
+		{"htpasswd user", "bob", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+			r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+			r.Header.Del("Authorization")
+		}
+		w := httptest.NewRecorder()
+		if _, ok := h.authorize(w, r, entry, "example.com"); ok {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusProxyAuthRequired && w.Header().Get("Proxy-Authenticate") != `Basic realm="office", charset="UTF-8"` {
+			t.Errorf("%s: unexpected challenge %q", tt.name, w.Header().Get("Proxy-Authenticate"))
+		}
+	}
+
+	if _, err := newAuthenticator(&config.ProxyAuth{Users: []*config.ProxyUser{{Name: "carol"}}}); err == nil {
+		t.Error("expected a user without password to be rejected")
+	}
+}
+
+func TestProxyAuthorizationFallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "fallback")
+	}))
+	defer backend.Close()
+	entry := config.EntryPoint{
+		Routing:  config.RouterHTTPHeader,
+		Fallback: backend.Listener.Addr().String(),
+		Auth:     &config.ProxyAuth{Users: []*config.ProxyUser{{Name: "alice", Password: "wonderland"}}},
+	}
+	if err := setupAuth(entry); err != nil {
+		t.Fatal(err)
+	}
+	defer Reset()
+	h := &httpProxyHandler{ctx: t.Context(), logger: zap.NewNop(), entry: entry}
+
+	// The Host is not routable, so the request would go to the fallback backend
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("got status %d without credentials, want %d", w.Code, http.StatusProxyAuthRequired)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wonderland")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "fallback" {
+		t.Errorf("got %d %q with credentials, want the fallback response", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyAuthorizationBeforeHostChecks(t *testing.T) {
+	office := netip.MustParsePrefix("10.0.0.0/8")
+	entry := config.EntryPoint{
+		Routing:   config.RouterHTTPHeader,
+		AllowFrom: []*config.AddrMatcher{{Prefix: &office}},
+		Auth:      &config.ProxyAuth{Users: []*config.ProxyUser{{Name: "alice", Password: "wonderland"}}},
+	}
+	if err := setupAuth(entry); err != nil {
+		t.Fatal(err)
+	}
+	defer Reset()
+	tag := "group"
+	registerHTTPTaggedEntry(tag, entry)
+	h := &httpProxyHandler{ctx: t.Context(), logger: zap.NewNop(), entry: entry, tag: &tag}
+
+	// No entry of the group serves the client, that is only disclosed after authentication
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("got status %d without credentials, want %d", w.Code, http.StatusProxyAuthRequired)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wonderland")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || w.Header().Get(errorHeader) != codeBlockedHost {
+		t.Errorf("got %d with %s %q, want the host to be blocked", w.Code, errorHeader, w.Header().Get(errorHeader))
+	}
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/fmotalleb/go-tools/log"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/httpcache"
+)
+
+const methodPurge = "PURGE"
+
+var (
+	cacheMu sync.Mutex
+	caches  = map[*config.Cache]*httpcache.Cache{}
+)
+
+func init() {
+	registerReset(func() {
+		cacheMu.Lock()
+		defer cacheMu.Unlock()
+		caches = make(map[*config.Cache]*httpcache.Cache)
+	})
+}
+
+// SetupCaches opens the response caches of the entries, invalid cache configs are reported before any listener starts.
+func SetupCaches(ctx context.Context, entries []config.EntryPoint) error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for _, e := range entries {
+		if e.Cache == nil || caches[e.Cache] != nil {
+			continue
+		}
+		logger := log.FromContext(ctx).Named("router.cache").With(zap.String("listen", e.Listen.String()))
+		c, err := httpcache.New(e.Cache, logger)
+		if err != nil {
+			return err
+		}
+		caches[e.Cache] = c
+	}
+	return nil
+}
+
+func cacheFor(entry config.EntryPoint) *httpcache.Cache {
+	if entry.Cache == nil {
+		return nil
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	return caches[entry.Cache]
+}
+
+// cachedTransport wraps rt with the response cache of entry, if it has one.
+func cachedTransport(entry config.EntryPoint, rt http.RoundTripper) http.RoundTripper {
+	if c := cacheFor(entry); c != nil {
+		return c.Transport(rt)
+	}
+	return rt
+}
+
+// handlePurge answers PURGE requests of clients allowed by cache.purge_from, key is the upstream URL of the request.
+// It reports whether the request was a PURGE.
+func handlePurge(w http.ResponseWriter, r *http.Request, entry config.EntryPoint, key string, logger *zap.Logger) bool {
+	if r.Method != methodPurge {
+		return false
+	}
+	c := cacheFor(entry)
+	if c == nil {
+		writeError(w, r, entry, cacheDisabled)
+		return true
+	}
+	if !c.Config().PurgeAllowed(addrFromRemote(r.RemoteAddr)) {
+		logger.Debug("purge rejected", zap.String("client", r.RemoteAddr), zap.String("url", key))
+		writeError(w, r, entry, purgeDenied)
+		return true
+	}
+	n := c.Purge(key)
+	logger.Info("cache purged", zap.String("client", r.RemoteAddr), zap.String("url", key), zap.Int("entries", n))
+	if n == 0 {
+		writeError(w, r, entry, notCached)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("Purged " + strconv.Itoa(n) + "\n"))
+	return true
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// originHeaders carry absolute URLs or origins of the upstream.
+var originHeaders = map[string]bool{
+	"Location":                            true,
+	"Content-Location":                    true,
+	"Content-Security-Policy":             true,
+	"Content-Security-Policy-Report-Only": true,
+	"Access-Control-Allow-Origin":         true,
+}
+
+// headerRewriter maps the upstream hosts of replace_host to their local names in headers that need more than
+// a string replacement: cookie domains and origins, whose scheme differs between the two sides.
+type headerRewriter struct {
+	hosts       [][2]string // upstream, local
+	stripSecure bool
+	downgrade   bool              // upstream is https while clients use plain http
+	respOrigins *strings.Replacer // upstream origins -> local origins
+	reqOrigins  *strings.Replacer // local origins -> upstream origins
+}
+
+// newHeaderRewriter builds the rewriter from upstream, local pairs. Clients talk plain HTTP to the proxy,
+// so https/wss origins of the upstream become http/ws origins locally and the other way around.
+func newHeaderRewriter(respReplacements []string, upstreamScheme string, stripSecure bool) *headerRewriter {
+	h := &headerRewriter{stripSecure: stripSecure, downgrade: upstreamScheme == "https"}
+	var resp, req []string
+	for i := 0; i+1 < len(respReplacements); i += 2 {
+		upstream, local := respReplacements[i], respReplacements[i+1]
+		h.hosts = append(h.hosts, [2]string{upstream, local})
+		if h.downgrade {
+			resp = append(resp, "https://"+upstream, "http://"+local, "wss://"+upstream, "ws://"+local)
+			req = append(req, "http://"+local, "https://"+upstream, "ws://"+local, "wss://"+upstream)
+		}
+		resp = append(resp, upstream, local)
+		req = append(req, local, upstream)
+	}
+	h.respOrigins = strings.NewReplacer(resp...)
+	h.reqOrigins = strings.NewReplacer(req...)
+	return h
+}
+
+// response rewrites a response header value, ok is false for headers left to the plain replacer.
+func (h *headerRewriter) response(key, value string) (string, bool) {
+	key = http.CanonicalHeaderKey(key)
+	switch {
+	case key == "Set-Cookie":
+		return h.setCookie(value), true
+	case key == "Content-Security-Policy" && h.downgrade:
+		return h.respOrigins.Replace(dropDirective(value, "upgrade-insecure-requests")), true
+	case originHeaders[key]:
+		return h.respOrigins.Replace(value), true
+	default:
+		return value, false
+	}
+}
+
+// request rewrites the Origin and Referer headers of src into the request sent upstream.
+func (h *headerRewriter) request(dst, src http.Header) {
+	for _, key := range []string{"Origin", "Referer"} {
+		if v := src.Get(key); v != "" {
+			dst.Set(key, h.reqOrigins.Replace(v))
+		}
+	}
+}
+
+// setCookie maps the cookie domain to the local host and drops Secure when the client side is plain HTTP.
+// Cookies that cannot be parsed are passed through as is.
+func (h *headerRewriter) setCookie(value string) string {
+	cookie, err := http.ParseSetCookie(value)
+	if err != nil {
+		return value
+	}
+	if cookie.Domain != "" {
+		cookie.Domain = h.cookieDomain(cookie.Domain)
+	}
+	if h.stripSecure && cookie.Secure {
+		cookie.Secure = false
+		if cookie.SameSite == http.SameSiteNoneMode {
+			// Browsers reject SameSite=None without Secure
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+	}
+	if s := cookie.String(); s != "" {
+		return s
+	}
+	return value
+}
+
+// cookieDomain returns the local cookie domain of an upstream one. Domains of mapped upstreams (or their parents)
+// become host-only cookies when the local name cannot be a cookie domain (IPs, single labels), unrelated domains
+// are kept.
+func (h *headerRewriter) cookieDomain(domain string) string {
+	d := strings.ToLower(strings.TrimPrefix(domain, "."))
+	for _, pair := range h.hosts {
+		upstream := strings.ToLower(hostOnly(pair[0]))
+		if upstream != d && !strings.HasSuffix(upstream, "."+d) {
+			continue
+		}
+		local := hostOnly(pair[1])
+		if upstream != d || net.ParseIP(local) != nil || !strings.Contains(local, ".") {
+			return ""
+		}
+		return local
+	}
+	return domain
+}
+
+// dropDirective removes a directive from a policy, upgrade-insecure-requests would send the client back to
+// an https origin the proxy does not serve.
+func dropDirective(policy, name string) string {
+	var kept []string
+	for directive := range strings.SplitSeq(policy, ";") {
+		directive = strings.TrimSpace(directive)
+		fields := strings.Fields(directive)
+		if directive == "" || strings.EqualFold(fields[0], name) {
+			continue
+		}
+		kept = append(kept, directive)
+	}
+	return strings.Join(kept, "; ")
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderRewriterResponse(t *testing.T) {
+	h := newHeaderRewriter([]string{
+		"example.com", "127.0.0.1:8080",
+		"api.example.org", "api.local.test",
+	}, "https", true)
+
+	tests := []struct {
+		key, in, want string
+	}{
+		{"Set-Cookie", "sid=1; Domain=.example.com; Path=/; Secure; HttpOnly; SameSite=None", "sid=1; Path=/; HttpOnly; SameSite=Lax"},
+		{"Set-Cookie", "sid=1; Domain=example.org; Secure", "sid=1"},
+		{"Set-Cookie", "sid=1; Domain=api.example.org; SameSite=Strict", "sid=1; Domain=api.local.test; SameSite=Strict"},
+		{"Set-Cookie", "sid=1; Domain=other.net", "sid=1; Domain=other.net"},
+		{"location", "https://example.com/login?next=/", "http://127.0.0.1:8080/login?next=/"},
+		{"Access-Control-Allow-Origin", "https://api.example.org", "http://api.local.test"},
+		{
+			"Content-Security-Policy",
+			"default-src 'self' https://example.com wss://api.example.org; upgrade-insecure-requests",
+			"default-src 'self' http://127.0.0.1:8080 ws://api.local.test",
+		},
+	}
+	for _, tt := range tests {
+		got, ok := h.response(tt.key, tt.in)
+		if !ok {
+			t.Errorf("%s: expected header to be rewritten", tt.key)
+		}
+		if got != tt.want {
+			t.Errorf("%s %q:\n got %q\nwant %q", tt.key, tt.in, got, tt.want)
+		}
+	}
+
+	if _, ok := h.response("Content-Type", "text/html"); ok {
+		t.Error("expected other headers to be left to the body replacer")
+	}
+}
+
+func TestHeaderRewriterKeepsSecureByDefault(t *testing.T) {
+	h := newHeaderRewriter([]string{"example.com", "proxy.test"}, "https", false)
+	got, _ := h.response("Set-Cookie", "sid=1; Domain=example.com; Secure; SameSite=None")
+	if want := "sid=1; Domain=proxy.test; Secure; SameSite=None"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderRewriterRequest(t *testing.T) {
+	h := newHeaderRewriter([]string{"example.com", "127.0.0.1:8080"}, "https", false)
+	src := http.Header{}
+	src.Set("Origin", "http://127.0.0.1:8080")
+	src.Set("Referer", "http://127.0.0.1:8080/page")
+	dst := http.Header{}
+	h.request(dst, src)
+	if got := dst.Get("Origin"); got != "https://example.com" {
+		t.Errorf("origin: got %q", got)
+	}
+	if got := dst.Get("Referer"); got != "https://example.com/page" {
+		t.Errorf("referer: got %q", got)
+	}
+}
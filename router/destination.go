@@ -0,0 +1,78 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/proxy"
+)
+
+const resolveTimeout = 10 * time.Second
+
+var errDestinationDenied = errors.New("destination denied by policy")
+
+// guardedDialer enforces the destination policy of an entrypoint on top of its proxy chain.
+// For direct chains the target is resolved locally and only allowed addresses are dialed,
+// so the checked address is the one connected to. Proxy chains resolve names remotely,
+// in that case only literal addresses can be checked and names resolving to internal addresses pass.
+type guardedDialer struct {
+	dialer xproxy.Dialer
+	entry  config.EntryPoint
+	logger *zap.Logger
+}
+
+// newGuardedDialer returns the dialer of entry used for client chosen targets.
+func newGuardedDialer(entry config.EntryPoint, logger *zap.Logger) (xproxy.Dialer, error) {
+	dialer, err := proxy.NewDialer(entry.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &guardedDialer{dialer: dialer, entry: entry, logger: logger}, nil
+}
+
+func (d *guardedDialer) Dial(network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !d.entry.DestinationAllowed(ip) {
+			d.logger.Warn("destination denied", zap.String("target", address))
+			return nil, fmt.Errorf("%w: %s", errDestinationDenied, address)
+		}
+		return d.dialer.Dial(network, address)
+	}
+	if !d.entry.IsDirect() {
+		return d.dialer.Dial(network, address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error = fmt.Errorf("%w: %s", errDestinationDenied, address)
+	for _, ip := range ips {
+		if !d.entry.DestinationAllowed(ip) {
+			d.logger.Warn("destination resolved to a denied address",
+				zap.String("target", address),
+				zap.String("resolved", ip.String()),
+			)
+			continue
+		}
+		conn, err := d.dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+type drainKey struct{}
+
+// drainer keeps relays alive after listeners are closed, until they finish or the drain deadline is reached.
+type drainer struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	active int
+	idle   chan struct{}
+}
+
+// WithDrain attaches a connection context to ctx that outlives ctx by at most timeout.
+// Listeners should stop on ctx cancellation while open relays keep running on the connection context,
+// once the deadline is reached they are forcibly closed.
+// The returned wait function blocks until all tracked relays are finished or the deadline is reached.
+func WithDrain(ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	connCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	d := &drainer{
+		ctx:  connCtx,
+		idle: make(chan struct{}),
+	}
+	close(d.idle)
+	context.AfterFunc(ctx, func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-connCtx.Done():
+		}
+	})
+	wait := func() {
+		defer cancel()
+		d.mu.Lock()
+		idle := d.idle
+		d.mu.Unlock()
+		select {
+		case <-idle:
+		case <-connCtx.Done():
+		}
+	}
+	return context.WithValue(ctx, drainKey{}, d), wait
+}
+
+// connContext returns the context that relays must observe, falls back to ctx itself if no drainer is attached.
+func connContext(ctx context.Context) context.Context {
+	if d, ok := ctx.Value(drainKey{}).(*drainer); ok {
+		return d.ctx
+	}
+	return ctx
+}
+
+// trackConn registers an open relay, the returned function must be called once the relay is finished.
+func trackConn(ctx context.Context) (context.Context, func()) {
+	d, ok := ctx.Value(drainKey{}).(*drainer)
+	if !ok {
+		return ctx, func() {}
+	}
+	d.mu.Lock()
+	if d.active == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.active++
+	d.mu.Unlock()
+
+	var once sync.Once
+	return d.ctx, func() {
+		once.Do(func() {
+			d.mu.Lock()
+			d.active--
+			if d.active == 0 {
+				close(d.idle)
+			}
+			d.mu.Unlock()
+		})
+	}
+}
+
+// serveHTTP runs srv until ctx is canceled, then stops accepting and waits for in-flight requests
+// until the drain deadline before closing the server forcibly.
+// Connections are subject to the admission control of the entry, TLS is served when srv.TLSConfig is set.
+func serveHTTP(ctx context.Context, srv *http.Server, entry config.EntryPoint, logger *zap.Logger) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		if err := srv.Shutdown(connContext(ctx)); err != nil {
+			logger.Warn("drain deadline reached, closing http server", zap.Error(err))
+			_ = srv.Close()
+		}
+	})
+	defer stop()
+	limited := limitListener(ctx, ln, entry, logger)
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(limited, "", "")
+	} else {
+		err = srv.Serve(limited)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
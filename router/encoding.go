@@ -0,0 +1,173 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionPreference lists the encodings a rewritten body may be re-compressed with, preferred first.
+var compressionPreference = []string{"br", "zstd", "gzip"}
+
+// decodableEncodings are the content codings decodeBody understands.
+var decodableEncodings = map[string]bool{
+	"identity": true,
+	"gzip":     true,
+	"x-gzip":   true,
+	"deflate":  true,
+	"br":       true,
+	"zstd":     true,
+}
+
+// encodeWriter is a compressing writer that can flush partial output, used for streamed responses.
+type encodeWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// decodeBody returns the decoded response body, codings are removed in reverse order of application.
+// Unsupported encodings are reported as errors, resp.Body is then left readable from its first byte so the
+// response can still be passed through.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	codings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	raw := &replayReader{r: resp.Body}
+	var body io.ReadCloser = readCloser{raw, resp.Body}
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		next, err := decodeReader(body, coding)
+		if err != nil {
+			resp.Body = readCloser{io.MultiReader(&raw.read, resp.Body), resp.Body}
+			return nil, err
+		}
+		body = next
+	}
+	raw.done = true
+	raw.read = bytes.Buffer{}
+	return body, nil
+}
+
+// replayReader keeps what the decoders read while they are set up, so a rejected body can be replayed.
+type replayReader struct {
+	r    io.Reader
+	read bytes.Buffer
+	done bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.done {
+		r.read.Write(p[:n])
+	}
+	return n, err
+}
+
+func decodeReader(r io.ReadCloser, coding string) (io.ReadCloser, error) {
+	switch coding {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{gz, r}, nil
+	case "deflate":
+		return deflateReader(r)
+	case "br":
+		return readCloser{brotli.NewReader(r), r}, nil
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{d, closerFunc(func() error {
+			d.Close()
+			return r.Close()
+		})}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", coding)
+	}
+}
+
+// deflateReader decodes "deflate" bodies, which should be zlib wrapped but are raw deflate on some servers.
+func deflateReader(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		z, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{z, r}, nil
+	}
+	return readCloser{flate.NewReader(br), r}, nil
+}
+
+// decodableAcceptEncoding keeps the codings of an Accept-Encoding header that decodeBody understands,
+// so rewritable responses are never sent in an encoding the proxy cannot read.
+func decodableAcceptEncoding(header string) string {
+	var kept []string
+	for part := range strings.SplitSeq(header, ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		if decodableEncodings[strings.ToLower(strings.TrimSpace(coding))] {
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// negotiateEncoding picks the preferred compression accepted by the client, empty means identity.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]float64)
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+	for _, enc := range compressionPreference {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// newEncoder returns a writer compressing into w with one of compressionPreference.
+func newEncoder(w io.Writer, encoding string) (encodeWriter, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,252 @@
+package router
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/proxy"
+	"github.com/fmotalleb/junction/quota"
+)
+
+const (
+	errorHeader     = "Junction-Error"
+	requestIDHeader = "Junction-Request-Id"
+
+	defaultErrorContentType = "text/html; charset=utf-8"
+	maxRequestIDLength      = 128
+)
+
+// Codes of the Junction-Error header, one per failure answered by the proxy itself.
+const (
+	codeBadHost            = "bad_host"
+	codeBlockedClient      = "blocked_client"
+	codeBlockedHost        = "blocked_host"
+	codeBlockedDestination = "blocked_destination"
+	codeAuthRequired       = "auth_required"
+	codeNoRoute            = "no_route"
+	codeCacheDisabled      = "cache_disabled"
+	codePurgeDenied        = "purge_denied"
+	codeNotCached          = "not_cached"
+	codeRateLimited        = "rate_limited"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeDialTimeout        = "dial_timeout"
+	codeDialFailed         = "dial_failed"
+	codeUpstreamTimeout    = "upstream_timeout"
+	codeUpstreamFailed     = "upstream_failed"
+	codeProxyAuthFailed    = "proxy_auth_failed"
+	codeProxyChain         = "proxy_chain"
+	codeInternal           = "internal"
+)
+
+var (
+	blockedClient   = proxyError{http.StatusForbidden, codeBlockedClient, "Your address is not allowed to use this proxy"}
+	blockedHost     = proxyError{http.StatusForbidden, codeBlockedHost, "The requested host is not allowed by this proxy"}
+	blockedUserHost = proxyError{http.StatusForbidden, codeBlockedHost, "The requested host is not allowed for this user"}
+	authRequired    = proxyError{http.StatusProxyAuthRequired, codeAuthRequired, "Proxy authentication required"}
+	noRoute         = proxyError{http.StatusNotFound, codeNoRoute, "No route matches the request"}
+	cacheDisabled   = proxyError{http.StatusNotFound, codeCacheDisabled, "Cache is not enabled"}
+	purgeDenied     = proxyError{http.StatusForbidden, codePurgeDenied, "Purge not allowed"}
+	notCached       = proxyError{http.StatusNotFound, codeNotCached, "Not cached"}
+	rateLimited     = proxyError{http.StatusTooManyRequests, codeRateLimited, "Request rate limit exceeded"}
+	quotaExceeded   = proxyError{http.StatusTooManyRequests, codeQuotaExceeded, "Traffic quota exceeded"}
+	proxyChainError = proxyError{http.StatusInternalServerError, codeProxyChain, "The proxy chain of this entrypoint is misconfigured"}
+	internalError   = proxyError{http.StatusInternalServerError, codeInternal, "Internal proxy error"}
+)
+
+var (
+	errorPagesMu sync.Mutex
+	errorPages   = map[*config.ErrorPages]*errorRenderer{}
+)
+
+func init() {
+	registerReset(func() {
+		errorPagesMu.Lock()
+		defer errorPagesMu.Unlock()
+		errorPages = make(map[*config.ErrorPages]*errorRenderer)
+	})
+}
+
+// proxyError is a failure answered by the proxy instead of the upstream.
+type proxyError struct {
+	status int
+	code   string
+	reason string
+}
+
+// upstreamError maps errors of dialing or requesting the upstream, dial is set for errors of opening the connection.
+func upstreamError(err error, dial bool) proxyError {
+	var opErr *net.OpError
+	dial = dial || errors.As(err, &opErr) && opErr.Op == "dial"
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+	switch {
+	case errors.Is(err, proxy.ErrProxyAuth):
+		return proxyError{http.StatusBadGateway, codeProxyAuthFailed, "The upstream proxy rejected the configured credentials"}
+	case errors.Is(err, errDestinationDenied):
+		return proxyError{http.StatusForbidden, codeBlockedDestination, "The destination address is not allowed by this proxy"}
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		return quotaExceeded
+	case dial && timeout:
+		return proxyError{http.StatusGatewayTimeout, codeDialTimeout, "Timed out connecting to the upstream"}
+	case dial:
+		return proxyError{http.StatusBadGateway, codeDialFailed, "Failed to connect to the upstream"}
+	case timeout:
+		return proxyError{http.StatusGatewayTimeout, codeUpstreamTimeout, "The upstream did not respond in time"}
+	default:
+		return proxyError{http.StatusBadGateway, codeUpstreamFailed, "The upstream request failed"}
+	}
+}
+
+// pageTemplate is implemented by both text and html templates.
+type pageTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// errorRenderer renders the error pages of an entrypoint.
+type errorRenderer struct {
+	page        pageTemplate
+	contentType string
+	status      map[string]int
+}
+
+// errorPage is the data of error page templates.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Code       string
+	Reason     string
+	Host       string
+	RequestID  string
+	Time       time.Time
+}
+
+// setupErrorPages compiles the error page template of entry once per config load.
+func setupErrorPages(entry config.EntryPoint) error {
+	if entry.ErrorPages == nil {
+		return nil
+	}
+	errorPagesMu.Lock()
+	defer errorPagesMu.Unlock()
+	if errorPages[entry.ErrorPages] != nil {
+		return nil
+	}
+	e, err := newErrorRenderer(entry.ErrorPages)
+	if err != nil {
+		return fmt.Errorf("%s: error_pages: %w", entry.Routing, err)
+	}
+	errorPages[entry.ErrorPages] = e
+	return nil
+}
+
+func newErrorRenderer(cfg *config.ErrorPages) (*errorRenderer, error) {
+	e := &errorRenderer{
+		contentType: cmp.Or(cfg.ContentType, defaultErrorContentType),
+		status:      cfg.Status,
+	}
+	text := cfg.Template
+	if text == "" && cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return e, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(e.contentType)
+	if err != nil {
+		return nil, fmt.Errorf("content_type: %w", err)
+	}
+	if strings.Contains(mediaType, "html") {
+		e.page, err = htmltemplate.New("error").Parse(text)
+	} else {
+		e.page, err = template.New("error").Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func errorRendererFor(entry config.EntryPoint) *errorRenderer {
+	if entry.ErrorPages == nil {
+		return nil
+	}
+	errorPagesMu.Lock()
+	defer errorPagesMu.Unlock()
+	return errorPages[entry.ErrorPages]
+}
+
+// writeError answers r with e. The code is sent in the Junction-Error header and the body is rendered
+// by the error pages of entry, or is the plain text reason.
+func writeError(w http.ResponseWriter, r *http.Request, entry config.EntryPoint, e proxyError) {
+	renderer := errorRendererFor(entry)
+	if renderer != nil {
+		e.status = cmp.Or(renderer.status[e.code], e.status)
+	}
+	id := requestID(r)
+	w.Header().Set(errorHeader, e.code)
+	w.Header().Set(requestIDHeader, id)
+
+	if renderer == nil || renderer.page == nil {
+		http.Error(w, e.reason, e.status)
+		return
+	}
+	var body bytes.Buffer
+	err := renderer.page.Execute(&body, errorPage{
+		Status:     e.status,
+		StatusText: http.StatusText(e.status),
+		Code:       e.code,
+		Reason:     e.reason,
+		Host:       r.Host,
+		RequestID:  id,
+		Time:       time.Now(),
+	})
+	if err != nil {
+		http.Error(w, e.reason, e.status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", renderer.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(body.Bytes())
+}
+
+// requestID returns the X-Request-Id of the client, or a random id when it has none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= maxRequestIDLength && isPrintable(id) {
+		return id
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func isPrintable(s string) bool {
+	for i := range len(s) {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
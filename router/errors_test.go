@@ -0,0 +1,79 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/proxy"
+)
+
+func TestUpstreamError(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		name   string
+		err    error
+		dial   bool
+		status int
+		code   string
+	}{
+		{"dial timeout", timeout, false, http.StatusGatewayTimeout, codeDialTimeout},
+		{"dial refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrClosed}, false, http.StatusBadGateway, codeDialFailed},
+		{"response timeout", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), false, http.StatusGatewayTimeout, codeUpstreamTimeout},
+		{"proxy auth", fmt.Errorf("SSH handshake failed: %w", proxy.ErrProxyAuth), true, http.StatusBadGateway, codeProxyAuthFailed},
+		{"destination", fmt.Errorf("%w: 10.0.0.1:80", errDestinationDenied), true, http.StatusForbidden, codeBlockedDestination},
+		{"other", errors.New("connection reset"), false, http.StatusBadGateway, codeUpstreamFailed},
+	}
+	for _, tt := range tests {
+		e := upstreamError(tt.err, tt.dial)
+		if e.status != tt.status || e.code != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, e.status, e.code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	defer Reset()
+	entry := config.EntryPoint{Routing: config.RouterHTTPHeader, ErrorPages: &config.ErrorPages{
+		Template: `<p>{{.Status}} {{.Code}} {{.Reason}} {{.Host}} {{.RequestID}}</p>`,
+		Status:   map[string]int{codeBlockedHost: http.StatusNotFound},
+	}}
+	if err := setupErrorPages(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://<b>.example.com/", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	writeError(w, r, entry, blockedHost)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want the configured %d", w.Code, http.StatusNotFound)
+	}
+	if w.Header().Get(errorHeader) != codeBlockedHost || w.Header().Get(requestIDHeader) != "req-1" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	want := "<p>404 blocked_host " + blockedHost.reason + " &lt;b&gt;.example.com req-1</p>"
+	if w.Body.String() != want {
+		t.Errorf("got body %q, want %q", w.Body.String(), want)
+	}
+
+	// Without error pages the reason is sent as plain text
+	w = httptest.NewRecorder()
+	writeError(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), config.EntryPoint{}, upstreamError(os.ErrDeadlineExceeded, true))
+	if w.Code != http.StatusGatewayTimeout || w.Header().Get(errorHeader) != codeDialTimeout {
+		t.Errorf("got %d %q, want %d %q", w.Code, w.Header().Get(errorHeader), http.StatusGatewayTimeout, codeDialTimeout)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || len(w.Header().Get(requestIDHeader)) != 16 {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+
+	if err := setupErrorPages(config.EntryPoint{ErrorPages: &config.ErrorPages{Template: "{{.Status"}}); err == nil {
+		t.Error("expected an invalid template to be rejected")
+	}
+}
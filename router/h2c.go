@@ -0,0 +1,262 @@
+package router
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+const (
+	// Upstreams that failed to speak h2c get the requests of HTTP/2 clients over HTTP/1.1 for this long
+	h2cRetryAfter = 10 * time.Minute
+	// Bound of the remembered upstreams, the oldest one is forgotten first
+	maxHTTP1Only = 1024
+)
+
+var (
+	http1OnlyMu sync.Mutex
+	http1Only   = map[string]time.Time{} // entry key|host → time h2c failed
+)
+
+func init() {
+	registerReset(func() {
+		http1OnlyMu.Lock()
+		defer http1OnlyMu.Unlock()
+		http1Only = make(map[string]time.Time)
+	})
+}
+
+// enableH2C makes srv accept cleartext HTTP/2, with prior knowledge (served by net/http) and by "Upgrade: h2c".
+func enableH2C(srv *http.Server, logger *zap.Logger) {
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	srv.Handler = &h2cUpgradeHandler{next: srv.Handler, srv: srv, h2: new(http2.Server), logger: logger}
+}
+
+// h2cUpgradeHandler switches HTTP/1.1 connections asking for "Upgrade: h2c" to HTTP/2 (RFC 7540 section 3.2),
+// the upgrading request is answered on stream 1.
+type h2cUpgradeHandler struct {
+	next   http.Handler
+	srv    *http.Server
+	h2     *http2.Server
+	logger *zap.Logger
+}
+
+func (h *h2cUpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 1 ||
+		!httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], "h2c") ||
+		!httpguts.HeaderValuesContainsToken(r.Header["Connection"], "HTTP2-Settings") {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(r.Header.Get("HTTP2-Settings"))
+	// Requests with a body keep HTTP/1.1, the body would have to be buffered before switching
+	upgrade := err == nil && len(r.Header.Values("HTTP2-Settings")) == 1 && r.ContentLength == 0
+	// The upgrade is for this hop, it must not be relayed like a WebSocket upgrade
+	r.Header.Del("Upgrade")
+	r.Header.Del("Connection")
+	r.Header.Del("HTTP2-Settings")
+	if !upgrade {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.logger.Debug("h2c upgrade skipped", zap.Error(err))
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	defer conn.Close()
+	if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	h.h2.ServeConn(&bufferedConn{Conn: conn, r: rw.Reader}, &http2.ServeConnOpts{
+		Context:        r.Context(),
+		BaseConfig:     h.srv,
+		Handler:        h.next,
+		UpgradeRequest: r,
+		Settings:       settings,
+	})
+}
+
+// bufferedConn reads the bytes the client sent after the upgrade request before reading conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// tunnelConn returns the client side of an accepted CONNECT tunnel, the hijacked connection of HTTP/1.1 clients
+// and the request stream of HTTP/2 clients.
+func tunnelConn(w http.ResponseWriter, r *http.Request, entry config.EntryPoint, logger *zap.Logger) (net.Conn, []byte, bool) {
+	if r.ProtoMajor < 2 {
+		return hijack(w, r, entry, logger)
+	}
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		logger.Debug("CONNECT stream failed", zap.Error(err))
+		return nil, nil, false
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &streamConn{body: r.Body, w: w, rc: rc, local: local, remote: addrFromRemote(r.RemoteAddr)}, nil, true
+}
+
+// streamConn is a CONNECT stream of an HTTP/2 client, reads come from the request body and writes are flushed
+// to the client right away.
+type streamConn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close ends both directions, writes blocked by flow control are released by the expired deadline.
+func (c *streamConn) Close() error {
+	_ = c.rc.SetWriteDeadline(time.Now())
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.rc.SetReadDeadline(t), c.rc.SetWriteDeadline(t))
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// sendUpstream sends req to target. With pool.h2c, requests of HTTP/2 clients go over h2c so gRPC and other
+// HTTP/2 only traffic keeps working, upstreams that do not speak h2c get HTTP/1.1 when the request can still be
+// sent again.
+func sendUpstream(r, req *http.Request, target httpTarget) (*http.Response, error) {
+	key := entryKey(target.entry) + "|" + target.host
+	if r.ProtoMajor != 2 || target.entry.Pool == nil || !target.entry.Pool.H2C || !h2cAllowed(key) {
+		return doUpstream(entryTransport(target.entry), req, target.entry, target.dial)
+	}
+	var body *unreadBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &unreadBody{ReadCloser: req.Body}
+		req.Body = body
+	}
+	// Only a fresh connection that failed tells the upstream does not speak h2c, dial errors do not
+	var dialed atomic.Bool
+	dial := func(network, address string) (net.Conn, error) {
+		conn, err := target.dial(network, address)
+		if err == nil {
+			dialed.Store(true)
+		}
+		return conn, err
+	}
+	resp, err := doUpstream(entryH2CTransport(target.entry), req, target.entry, dial)
+	if err == nil || !dialed.Load() || req.Context().Err() != nil {
+		return resp, err
+	}
+	markHTTP1Only(key)
+	if body != nil && body.read.Load() {
+		return nil, err
+	}
+	return doUpstream(entryTransport(target.entry), req, target.entry, target.dial)
+}
+
+// doUpstream sends req over the pooled transport rt, connections are opened with dial.
+func doUpstream(rt *http.Transport, req *http.Request, entry config.EntryPoint, dial func(network, address string) (net.Conn, error)) (*http.Response, error) {
+	client := &http.Client{
+		Transport: cachedTransport(entry, rt),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// Redirects are for the client to follow, the dial function only serves this target
+			return http.ErrUseLastResponse
+		},
+	}
+	return client.Do(req.WithContext(withDial(req.Context(), dial)))
+}
+
+func h2cAllowed(key string) bool {
+	http1OnlyMu.Lock()
+	defer http1OnlyMu.Unlock()
+	failed, ok := http1Only[key]
+	if ok && time.Since(failed) > h2cRetryAfter {
+		delete(http1Only, key)
+		return true
+	}
+	return !ok
+}
+
+// markHTTP1Only remembers that the upstream of key does not speak h2c, keeping at most maxHTTP1Only upstreams.
+func markHTTP1Only(key string) {
+	http1OnlyMu.Lock()
+	defer http1OnlyMu.Unlock()
+	if _, ok := http1Only[key]; !ok && len(http1Only) >= maxHTTP1Only {
+		oldest, oldestAt := "", time.Now()
+		for k, failed := range http1Only {
+			if time.Since(failed) > h2cRetryAfter {
+				delete(http1Only, k)
+			} else if failed.Before(oldestAt) {
+				oldest, oldestAt = k, failed
+			}
+		}
+		if len(http1Only) >= maxHTTP1Only {
+			delete(http1Only, oldest)
+		}
+	}
+	http1Only[key] = time.Now()
+}
+
+// unreadBody records whether the transport started reading the body. Closing is left to the server so the
+// body can be sent again over another transport.
+type unreadBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unreadBody) Close() error {
+	return nil
+}
+
+// writeTrailers sends the trailers of resp after its body, gRPC reports the call status in them.
+func writeTrailers(w http.ResponseWriter, resp *http.Response) {
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
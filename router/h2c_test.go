@@ -0,0 +1,235 @@
+package router
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+// newH2CProxy starts an http-header proxy sending every request to port on the host it names, over h2c for
+// HTTP/2 clients when upstreamH2C is set.
+func newH2CProxy(t *testing.T, port string, upstreamH2C bool) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewUnstartedServer(&httpProxyHandler{
+		ctx:        t.Context(),
+		logger:     zap.NewNop(),
+		targetPort: port,
+		entry: config.EntryPoint{
+			Routing:       config.RouterHTTPHeader,
+			AllowInternal: true,
+			Pool:          &config.Pool{H2C: upstreamH2C},
+		},
+	})
+	enableH2C(proxy.Config, zap.NewNop())
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func newH2CClient() *http.Client {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: tr}
+}
+
+func TestH2CKeepsHTTP2Upstream(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			t.Errorf("backend got %s with te %q, want HTTP/2 with te trailers", r.Proto, r.Header.Get("Te"))
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = io.WriteString(w, "message")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	proxy := newH2CProxy(t, port, true)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, proxy.URL+"/svc.Echo/Call", strings.NewReader("call"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "127.0.0.1"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := newH2CClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(body) != "message" {
+		t.Errorf("got %s %q, want HTTP/2 message", resp.Proto, body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("expected the grpc-status trailer, got %v", resp.Trailer)
+	}
+}
+
+func TestH2CFallsBackToHTTP1Upstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	proxy := newH2CProxy(t, port, true)
+	defer Reset()
+
+	for range 2 {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxy.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "127.0.0.1"
+		resp, err := newH2CClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "HTTP/1.1" {
+			t.Errorf("got %d %q, want the HTTP/1.1 upstream response", resp.StatusCode, body)
+		}
+	}
+}
+
+func TestH2CUpstreamOptIn(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, r.Proto+" "+string(body))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	proxy := newH2CProxy(t, port, false)
+	defer Reset()
+
+	// Without pool.h2c the body is sent once, over HTTP/1.1
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, proxy.URL+"/", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "127.0.0.1"
+	resp, err := newH2CClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "HTTP/1.1 payload" {
+		t.Errorf("got %d %q, want the HTTP/1.1 upstream response", resp.StatusCode, body)
+	}
+}
+
+func TestHTTP1OnlyBounded(t *testing.T) {
+	defer Reset()
+	for i := range maxHTTP1Only + 10 {
+		markHTTP1Only(strconv.Itoa(i))
+	}
+	if n := len(http1Only); n != maxHTTP1Only {
+		t.Errorf("got %d remembered upstreams, want %d", n, maxHTTP1Only)
+	}
+	if h2cAllowed(strconv.Itoa(maxHTTP1Only + 9)) {
+		t.Error("expected the latest upstream to be remembered")
+	}
+}
+
+func TestH2CConnectStream(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	proxy := newH2CProxy(t, port, true)
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	pr, pw := io.Pipe()
+	req := (&http.Request{Method: http.MethodConnect, URL: proxyURL, Host: "127.0.0.1:" + port, Header: http.Header{}, Body: pr}).WithContext(t.Context())
+	resp, err := newH2CClient().Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if _, err := io.WriteString(pw, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q, %v through the tunnel, want ping", buf, err)
+	}
+	_ = pw.Close()
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.Header.Get("Http2-Settings") != "" {
+			t.Errorf("upgrade headers reached the backend: %v", r.Header)
+		}
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	proxy := newH2CProxy(t, port, true)
+	defer Reset()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+
+	_, _ = io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, br)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, ok := f.(*http2.MetaHeadersFrame); ok {
+			if h.StreamID != 1 || h.PseudoValue("status") != "200" {
+				t.Errorf("got status %q on stream %d, want 200 on stream 1", h.PseudoValue("status"), h.StreamID)
+			}
+			return
+		}
+	}
+}
@@ -30,16 +30,21 @@ func dialTarget(proxyAddr []*url.URL, target string, logger *zap.Logger) (net.Co
 }
 
 // relayTraffic concurrently relays data between two network connections in both directions until either connection is closed or an error occurs.
+// Traffic of both directions is throttled by the given buckets.
+// Both connections are closed once ctx is canceled.
 // Logs connection closure and errors for diagnostic purposes.
-func relayTraffic(ctx context.Context, src, dst net.Conn, logger *zap.Logger) {
-	defer func() {
+func relayTraffic(ctx context.Context, src, dst net.Conn, logger *zap.Logger, buckets ...*utils.Bucket) {
+	closeBoth := func() {
 		_ = src.Close()
 		_ = dst.Close()
-	}()
-	errs, _ := errgroup.WithContext(ctx)
+	}
+	defer closeBoth()
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+	errs, copyCtx := errgroup.WithContext(ctx)
 	errs.Go(
 		func() error {
-			if err := utils.Copy(dst, src); err != nil {
+			if err := utils.Copy(copyCtx, dst, src, buckets...); err != nil {
 				return errors.Join(errors.New("failed to write to dst"), err)
 			} else {
 				return nil
@@ -48,7 +53,7 @@ func relayTraffic(ctx context.Context, src, dst net.Conn, logger *zap.Logger) {
 	)
 	errs.Go(
 		func() error {
-			if err := utils.Copy(src, dst); err != nil {
+			if err := utils.Copy(copyCtx, src, dst, buckets...); err != nil {
 				return errors.Join(errors.New("failed to write to dst"), err)
 			} else {
 				return nil
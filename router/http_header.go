@@ -17,9 +17,10 @@ import (
 
 	"github.com/fmotalleb/go-tools/log"
 	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/fmotalleb/junction/config"
-	"github.com/fmotalleb/junction/proxy"
+	"github.com/fmotalleb/junction/quota"
 	"github.com/fmotalleb/junction/utils"
 )
 
@@ -59,6 +60,16 @@ func httpHandler(ctx context.Context, entry config.EntryPoint) (bool, error) {
 		return false, nil
 	}
 
+	if err := compileRewrites(entry); err != nil {
+		return true, err
+	}
+	if err := setupAuth(entry); err != nil {
+		return true, err
+	}
+	if err := setupErrorPages(entry); err != nil {
+		return true, err
+	}
+
 	// --- Tag registration ---
 	if entry.Tag != nil {
 		isFirst := registerHTTPTaggedEntry(*entry.Tag, entry)
@@ -78,25 +89,25 @@ func httpHandler(ctx context.Context, entry config.EntryPoint) (bool, error) {
 
 	server := &http.Server{
 		ReadHeaderTimeout: time.Second * 30,
-		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+		BaseContext:       func(_ net.Listener) context.Context { return connContext(ctx) },
 		Addr:              entry.Listen.String(),
 		Handler: &httpProxyHandler{
 			ctx:          ctx,
 			logger:       logger,
-			proxyAddr:    entry.Proxy,
 			targetPort:   entry.GetTargetOr(DefaultHTTPPort),
 			entry:        entry,
 			tag:          entry.Tag, // NEW FIELD
 			flexiblePort: utils.PopInPlace(&features, flexiblePortFeature),
 		},
 	}
+	enableH2C(server, logger)
 	//nolint:gocritic // utils.PopInPlace removes the items from array so if the list of features is normal it will be empty here
 	if len(features) >= 0 {
 		logger.Warn("unused features in entrypoint", zap.Strings("features", features))
 	}
 	logger.Info("HTTP proxy booted")
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := serveHTTP(ctx, server, entry, logger); err != nil {
 		logger.Error("HTTP server error", zap.Error(err))
 		return true, errors.Join(
 			errors.New("failed to start listener for http proxy"),
@@ -124,7 +135,6 @@ func registerHTTPTaggedEntry(tag string, entry config.EntryPoint) bool {
 type httpProxyHandler struct {
 	ctx          context.Context
 	logger       *zap.Logger
-	proxyAddr    []*url.URL
 	targetPort   string
 	entry        config.EntryPoint
 	tag          *string // NEW
@@ -143,11 +153,17 @@ func (h *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	if err != nil {
 		h.logger.Warn("failed to prepare target host", zap.Error(err))
-		http.Error(w, "malformed host value, refusing to process request", http.StatusBadRequest)
+		if h.serveFallback(w, r, remoteAddr) {
+			return
+		}
+		writeError(w, r, h.entry, proxyError{http.StatusBadRequest, codeBadHost, "Malformed host value, refusing to process request"})
 		return
 	} else if targetHost == "" {
 		h.logger.Warn("failed to read target host")
-		http.Error(w, "malformed host value, failed to read the value, refusing to process request", http.StatusBadRequest)
+		if h.serveFallback(w, r, remoteAddr) {
+			return
+		}
+		writeError(w, r, h.entry, proxyError{http.StatusBadRequest, codeBadHost, "Missing host value, refusing to process request"})
 		return
 	}
 
@@ -155,55 +171,142 @@ func (h *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	entry := h.entry
 	if h.tag == nil && !entry.AllowedFrom(remoteAddr) {
 		h.logger.Debug("connection rejected", zap.String("client", r.RemoteAddr))
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, entry, blockedClient)
 		return
 	}
 	if h.tag != nil {
-		group := httpGroups[*h.tag]
-		matched := false
-
-		for _, ep := range group {
-			if ep.Allowed(targetHost) && ep.AllowedFrom(remoteAddr) {
-				entry = ep
-				matched = true
-				break
-			}
-		}
-
-		if !matched {
+		matched, ok := h.groupEntry(targetHost, remoteAddr)
+		if !ok {
 			h.logger.Warn("no matching entry for http request",
 				zap.String("hostname", targetHost),
 				zap.String("client", r.RemoteAddr),
 			)
-			w.WriteHeader(http.StatusForbidden)
+			if h.serveFallback(w, r, remoteAddr) {
+				return
+			}
+			// Unauthenticated clients are challenged before learning which hosts the group serves
+			if _, ok := h.authorize(w, r, h.entry, ""); ok {
+				writeError(w, r, h.entry, blockedHost)
+			}
 			return
 		}
+		entry = matched
 	}
 
+	// Clients authenticate before the host allow lists are evaluated, so they are not disclosed
+	h, ok := h.authorize(w, r, entry, targetHost)
+	if !ok {
+		return
+	}
 	if !entry.Allowed(targetHost) {
 		h.logger.Warn("hostname rejected", zap.String("hostname", targetHost))
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, entry, blockedHost)
 		return
 	}
-	if !entry.AllowedFrom(remoteAddr) {
-		h.logger.Debug("connection rejected", zap.String("client", r.RemoteAddr))
-		w.WriteHeader(http.StatusForbidden)
+
+	dial, err := targetDialer(r.Context(), entry, hostOnly(targetHost), portOr(targetHost, defaultRequestPort(r)), h.logger)
+	if err != nil {
+		writeError(w, r, entry, proxyChainError)
+		return
+	}
+	h.forward(w, r, httpTarget{entry: entry, host: targetHost, dial: dial}, remoteAddr)
+}
+
+// groupEntry returns the first entry of the tag group serving host to the client.
+func (h *httpProxyHandler) groupEntry(host string, remoteAddr net.Addr) (config.EntryPoint, bool) {
+	for _, ep := range httpGroups[*h.tag] {
+		if ep.Allowed(host) && ep.AllowedFrom(remoteAddr) {
+			return ep, true
+		}
+	}
+	return config.EntryPoint{}, false
+}
+
+// httpTarget is the upstream selected for a request.
+type httpTarget struct {
+	entry config.EntryPoint
+	host  string
+	dial  func(network, address string) (net.Conn, error)
+}
+
+// forward applies the rate limits and quotas of the target entry and proxies the request.
+func (h *httpProxyHandler) forward(w http.ResponseWriter, r *http.Request, target httpTarget, remoteAddr net.Addr) {
+	scopes := rateScopes(target.entry, clientIP(remoteAddr), hostOnly(target.host))
+	if !admitConn(scopes) {
+		h.logger.Warn("request rate limit exceeded", zap.String("client", r.RemoteAddr))
+		writeError(w, r, target.entry, rateLimited)
+		return
+	}
+	meter, err := newMeter(h.ctx, target.entry, remoteAddr)
+	if err != nil {
+		h.logger.Warn("request rejected", zap.String("client", r.RemoteAddr), zap.Error(err))
+		writeError(w, r, target.entry, quotaExceeded)
 		return
 	}
+	policy := trafficPolicy{buckets: bandwidthBuckets(scopes), meter: meter}
 
 	h.logger.Debug("HTTP request received",
 		zap.String("method", r.Method),
-		zap.String("targetHost", targetHost),
+		zap.String("targetHost", target.host),
 		zap.String("remoteAddr", r.RemoteAddr),
 	)
 
 	if r.Method == http.MethodConnect {
-		h.handleConnect(w, r, targetHost)
+		h.handleConnect(w, r, target, policy)
 	} else {
-		h.handleHTTPRequest(w, r, targetHost)
+		h.handleHTTPRequest(w, r, target, policy)
 	}
 }
 
+// serveFallback forwards a request that cannot be routed by its host to the fallback backend.
+// It reports false when no fallback applies.
+func (h *httpProxyHandler) serveFallback(w http.ResponseWriter, r *http.Request, remoteAddr net.Addr) bool {
+	var group []config.EntryPoint
+	if h.tag != nil {
+		group = httpGroups[*h.tag]
+	}
+	entry, ok := fallbackEntry(h.entry, group, remoteAddr)
+	if !ok {
+		return false
+	}
+	b := parseBackend(entry.Fallback, cmp.Or(entry.GetTargetOr(DefaultHTTPPort), defaultRequestPort(r)))
+	host := b.address
+	if b.network == "unix" {
+		host = "localhost"
+	}
+	// The credentials of the fallback entry apply, or those of the listener when it has none
+	authEntry := entry
+	if authEntry.Auth == nil {
+		authEntry = h.entry
+	}
+	h, ok = h.authorize(w, r, authEntry, "")
+	if !ok {
+		return true
+	}
+	h.logger.Debug("routing to fallback",
+		zap.String("client", r.RemoteAddr),
+		zap.String("backend", b.String()),
+	)
+	h.forward(w, r, httpTarget{entry: entry, host: host, dial: b.dialer(r.Context(), entry, h.logger)}, remoteAddr)
+	return true
+}
+
+// defaultRequestPort is the upstream port used when neither the request nor the config specifies one.
+func defaultRequestPort(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return "443"
+	}
+	return "80"
+}
+
+// hostOnly strips the port from host:port values.
+func hostOnly(hostPort string) string {
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		return host
+	}
+	return hostPort
+}
+
 func prepareTargetHost(hostHeader, targetPort string) (string, error) {
 	host := strings.TrimSpace(hostHeader)
 	if host == "" {
@@ -267,63 +370,62 @@ func isLocal(name string) bool {
 	return false
 }
 
-func (h *httpProxyHandler) handleConnect(w http.ResponseWriter, _ *http.Request, targetHost string) {
-	ctx, cancel := context.WithTimeout(h.ctx, h.entry.Timeout)
-	defer cancel()
-	dialer, err := proxy.NewDialer(h.proxyAddr)
-	if err != nil {
-		http.Error(w, "SOCKS5 dialer error", http.StatusInternalServerError)
+func (h *httpProxyHandler) handleConnect(w http.ResponseWriter, r *http.Request, target httpTarget, policy trafficPolicy) {
+	if i, ok := interceptorFor(target.entry, hostOnly(target.host)); ok {
+		w.WriteHeader(http.StatusOK)
+		clientConn, buffered, ok := tunnelConn(w, r, target.entry, h.logger)
+		if !ok {
+			return
+		}
+		interceptConn(h.ctx, i, quota.WrapConn(clientConn, policy.meter), buffered,
+			hostOnly(target.host), portOr(target.host, "443"), target.dial, h.logger, target.entry, policy.buckets)
 		return
 	}
 
-	targetConn, err := dialer.Dial("tcp", targetHost)
+	connCtx, done := trackConn(h.ctx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, target.entry.GetTimeout())
+	defer cancel()
+
+	targetConn, err := target.dial("tcp", target.host)
 	if err != nil {
-		h.logger.Debug("CONNECT failed", zap.String("target", targetHost), zap.Error(err))
-		http.Error(w, "Failed to connect to target", http.StatusBadGateway)
+		h.logger.Debug("CONNECT failed", zap.String("target", target.host), zap.Error(err))
+		writeError(w, r, target.entry, upstreamError(err, true))
 		return
 	}
 	defer targetConn.Close()
 
 	w.WriteHeader(http.StatusOK)
 
-	hijacker, ok := w.(http.Hijacker)
+	clientConn, _, ok := tunnelConn(w, r, target.entry, h.logger)
 	if !ok {
-		h.logger.Error("Hijacking unsupported")
-		http.Error(w, "Hijacking unsupported", http.StatusInternalServerError)
-		return
-	}
-
-	clientConn, _, err := hijacker.Hijack()
-	if err != nil {
-		h.logger.Error("Hijack failed", zap.Error(err))
-		http.Error(w, "Hijack failed", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
 
-	relayTraffic(ctx, clientConn, targetConn, h.logger)
+	relayTraffic(ctx, quota.WrapConn(clientConn, policy.meter), targetConn, h.logger, policy.buckets...)
 }
 
-func (h *httpProxyHandler) handleHTTPRequest(w http.ResponseWriter, r *http.Request, targetHost string) {
-	dialer, err := proxy.NewDialer(h.proxyAddr)
-	if err != nil {
-		http.Error(w, "SOCKS5 dialer error", http.StatusInternalServerError)
-		return
-	}
-
+func (h *httpProxyHandler) handleHTTPRequest(w http.ResponseWriter, r *http.Request, target httpTarget, policy trafficPolicy) {
 	targetURL := &url.URL{
 		Scheme:   "http",
-		Host:     targetHost,
+		Host:     target.host,
 		Path:     r.URL.Path,
 		RawQuery: r.URL.RawQuery,
 	}
 
-	req, err := http.NewRequestWithContext(h.ctx, r.Method, targetURL.String(), r.Body)
+	var body io.Reader = http.NoBody
+	// HTTP/2 requests without a body still have a Body, their ContentLength is 0
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		body = policy.reader(r.Context(), r.Body)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), body)
 	if err != nil {
 		h.logger.Error("Request creation failed", zap.Error(err))
-		http.Error(w, "Request creation failed", http.StatusInternalServerError)
+		writeError(w, r, target.entry, internalError)
 		return
 	}
+	req.ContentLength = r.ContentLength
 
 	// Copy headers
 	for k, v := range r.Header {
@@ -331,22 +433,60 @@ func (h *httpProxyHandler) handleHTTPRequest(w http.ResponseWriter, r *http.Requ
 			req.Header.Add(k, val)
 		}
 	}
+	removeHopHeaders(req.Header)
+	// Clients accepting trailers get them relayed, gRPC depends on it
+	if httpguts.HeaderValuesContainsToken(r.Header["Te"], "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+	rules := matchRewrites(target.entry, r)
+	rewriteRequest(rules, r, req)
+	if handlePurge(w, r, target.entry, req.URL.String(), h.logger) {
+		return
+	}
+	if isUpgradeRequest(r) {
+		keepUpgradeHeaders(req.Header, r.Header)
+		h.handleUpgrade(w, r, req, target, policy)
+		return
+	}
 
-	resp, err := (&http.Client{Transport: &http.Transport{Dial: dialer.Dial}}).Do(req)
+	resp, err := sendUpstream(r, req, target)
 	if err != nil {
 		h.logger.Error("Request to target failed", zap.String("url", targetURL.String()), zap.Error(err))
-		http.Error(w, "Request failed", http.StatusBadGateway)
+		writeError(w, r, target.entry, upstreamError(err, false))
 		return
 	}
 	defer resp.Body.Close()
 
+	removeHopHeaders(resp.Header)
+	rewriteResponse(rules, resp.Header)
 	for k, v := range resp.Header {
 		for _, val := range v {
 			w.Header().Add(k, val)
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	// HTTP/2 responses may be streams (gRPC), every read is passed on right away
+	if err := copyEncoded(w, policy.reader(r.Context(), resp.Body), "", resp.ProtoMajor == 2); err != nil {
 		h.logger.Error("Response copy failed", zap.Error(err))
+		return
+	}
+	writeTrailers(w, resp)
+}
+
+// handleUpgrade relays protocol upgrades (WebSocket, ...) over a dedicated upstream connection.
+func (h *httpProxyHandler) handleUpgrade(w http.ResponseWriter, r, out *http.Request, target httpTarget, policy trafficPolicy) {
+	connCtx, done := trackConn(h.ctx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, target.entry.GetTimeout())
+	defer cancel()
+
+	upstream, err := target.dial("tcp", target.host)
+	if err != nil {
+		h.logger.Debug("upgrade dial failed", zap.String("target", target.host), zap.Error(err))
+		writeError(w, r, target.entry, upstreamError(err, true))
+		return
+	}
+	if err := relayUpgrade(ctx, w, r, out, upstream, target.entry, h.logger, policy); err != nil {
+		writeError(w, r, target.entry, upstreamError(err, false))
 	}
 }
@@ -1,42 +1,51 @@
 package router
 
 import (
-	"bytes"
-	"compress/gzip"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/fmotalleb/go-tools/decoder"
 	"github.com/fmotalleb/go-tools/log"
 	"go.uber.org/zap"
 
 	"github.com/fmotalleb/junction/config"
 	"github.com/fmotalleb/junction/proxy"
+	"github.com/fmotalleb/junction/utils"
 )
 
+// defaultMaxRewriteSize bounds the bodies rewritten by replace_host.
+const defaultMaxRewriteSize = 16 << 20
+
 func init() {
 	registerHandler(httpToHTTPSHandler)
 }
 
 // httpToHTTPSHandler starts an HTTP server that reverse-proxies to an HTTPS backend.
 // Routing: config.RouterHTTPToHTTPS
+// Upgrade requests (WebSocket, ...) are relayed over a dedicated backend connection.
 //
 // Expected config.EntryPoint fields:
 //
 //	Entry.Listen        - where to listen, e.g. ":80"
-//	Entry.Target        - https backend URL, e.g. "https://google.com"
+//	Entry.Target        - https backend URL, e.g. "https://google.com", optional with routes
 //	Entry.ReplaceHost   - map[upstream_host]local_host
 //	                      Example: {"google.com": "127.0.0.1"}
 //	                      Request: 127.0.0.1 -> google.com
 //	                      Response: google.com -> 127.0.0.1
 //	Entry.Proxy         - optional SOCKS5 chain, same as http_header.go
 //	Entry.Timeout       - upstream timeout
+//	Entry.ExtraConf     - routes, max_rewrite_size, recompress, strip_secure_cookies and tls (upstream TLS client settings)
 func httpToHTTPSHandler(ctx context.Context, entry config.EntryPoint) (bool, error) {
 	if entry.Routing != config.RouterHTTPToHTTPS {
 		return false, nil
@@ -50,61 +59,19 @@ func httpToHTTPSHandler(ctx context.Context, entry config.EntryPoint) (bool, err
 			zap.String("target", entry.Target),
 		)
 
-	if entry.Target == "" {
-		return true, errors.New("http_to_https: entry.Target is required, e.g. https://google.com")
-	}
-
-	targetURL, err := url.Parse(entry.Target)
+	handler, err := newHTTPToHTTPSProxy(ctx, entry, logger)
 	if err != nil {
-		return true, fmt.Errorf("http_to_https: invalid target URL: %w", err)
-	}
-	if targetURL.Scheme != "https" {
-		logger.Warn("target scheme is not https", zap.String("scheme", targetURL.Scheme))
+		return true, fmt.Errorf("http_to_https: %w", err)
 	}
-
-	// Build replacers
-	// ReplaceHost is defined as map[upstream]local
-	// reqReplacer:  local -> upstream
-	// respReplacer: upstream -> local
-	var reqReplacements, respReplacements []string
-	if replaceHosts, ok := entry.ExtraConf["replace_host"]; ok {
-		var replaceMap map[string]any
-		if replaceMap, ok = replaceHosts.(map[string]any); !ok {
-			return true, errors.New("invalid replace map structure, expected string -> string map")
-		}
-		for upstream, localAddr := range replaceMap {
-			var local string
-			if local, ok = localAddr.(string); !ok {
-				return true, errors.New("invalid replace map structure, expected string -> string map, right side does not look like a string")
-			}
-			if upstream == "" || local == "" {
-				continue
-			}
-			// request: client sends local, we send upstream
-			reqReplacements = append(reqReplacements, local, upstream)
-			// response: backend sends upstream, we send local
-			respReplacements = append(respReplacements, upstream, local)
-		}
-	}
-	reqReplacer := strings.NewReplacer(reqReplacements...)
-	respReplacer := strings.NewReplacer(respReplacements...)
-
 	server := &http.Server{
 		ReadHeaderTimeout: 30 * time.Second,
-		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+		BaseContext:       func(_ net.Listener) context.Context { return connContext(ctx) },
 		Addr:              entry.Listen.String(),
-		Handler: &httpToHTTPSProxy{
-			ctx:          ctx,
-			logger:       logger,
-			entry:        entry,
-			targetURL:    targetURL,
-			reqReplacer:  reqReplacer,
-			respReplacer: respReplacer,
-		},
+		Handler:           handler,
 	}
 
-	logger.Info("HTTP->HTTPS proxy booted", zap.String("target", targetURL.String()))
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	logger.Info("HTTP->HTTPS proxy booted", zap.Int("routes", len(handler.routes)))
+	if err := serveHTTP(ctx, server, entry, logger); err != nil {
 		logger.Error("HTTP server error", zap.Error(err))
 		return true, errors.Join(
 			errors.New("failed to start listener for http_to_https proxy"),
@@ -115,12 +82,89 @@ func httpToHTTPSHandler(ctx context.Context, entry config.EntryPoint) (bool, err
 }
 
 type httpToHTTPSProxy struct {
-	ctx          context.Context
-	logger       *zap.Logger
-	entry        config.EntryPoint
-	targetURL    *url.URL
-	reqReplacer  *strings.Replacer
-	respReplacer *strings.Replacer
+	ctx    context.Context
+	logger *zap.Logger
+	entry  config.EntryPoint
+	// Requests matching no route go to target, nil when only routes are configured
+	target *httpsUpstream
+	routes []*httpsRoute
+
+	maxRewriteSize int64
+	recompress     bool
+	tlsConfig      *tls.Config // nil uses Go's defaults
+}
+
+// newHTTPToHTTPSProxy builds the handler of entry, target and routes are resolved once at boot.
+func newHTTPToHTTPSProxy(ctx context.Context, entry config.EntryPoint, logger *zap.Logger) (*httpToHTTPSProxy, error) {
+	if err := compileRewrites(entry); err != nil {
+		return nil, err
+	}
+	if err := setupErrorPages(entry); err != nil {
+		return nil, err
+	}
+	opts, err := decodeHTTPSOptions(entry.ExtraConf)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Target == "" && len(opts.Routes) == 0 {
+		return nil, errors.New("entry.Target or extra.routes is required, e.g. https://google.com")
+	}
+	tlsConfig, err := opts.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	h := &httpToHTTPSProxy{
+		ctx:            ctx,
+		logger:         logger,
+		entry:          entry,
+		routes:         opts.Routes,
+		maxRewriteSize: opts.MaxRewriteSize,
+		recompress:     opts.Recompress,
+		tlsConfig:      tlsConfig,
+	}
+	if entry.Target != "" {
+		replaceHost, err := parseReplaceHost(entry.ExtraConf)
+		if err != nil {
+			return nil, err
+		}
+		if h.target, err = newHTTPSUpstream(entry.Target, replaceHost, entry.Proxy, opts.StripSecureCookies); err != nil {
+			return nil, err
+		}
+	}
+	for _, route := range h.routes {
+		if err := route.compile(entry.Proxy, opts.StripSecureCookies); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range h.upstreams() {
+		if u.target.Scheme != "https" {
+			logger.Warn("target scheme is not https", zap.String("target", u.target.String()))
+		}
+	}
+	return h, nil
+}
+
+// upstreams lists the target and the upstreams of the routes.
+func (h *httpToHTTPSProxy) upstreams() []*httpsUpstream {
+	var all []*httpsUpstream
+	if h.target != nil {
+		all = append(all, h.target)
+	}
+	for _, route := range h.routes {
+		all = append(all, route.upstream)
+	}
+	return all
+}
+
+// route returns the upstream of the first matching route, falling back to target, and the path to send upstream.
+func (h *httpToHTTPSProxy) route(r *http.Request) (*httpsUpstream, string) {
+	host := hostOnly(r.Host)
+	for _, route := range h.routes {
+		if path, ok := route.match(host, r.URL.Path); ok {
+			return route.upstream, path
+		}
+	}
+	return h.target, r.URL.Path
 }
 
 func (h *httpToHTTPSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -128,56 +172,75 @@ func (h *httpToHTTPSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if !h.entry.AllowedFrom(remoteAddr) {
 		h.logger.Debug("connection rejected", zap.String("client", r.RemoteAddr))
-		w.WriteHeader(http.StatusForbidden)
+		writeError(w, r, h.entry, blockedClient)
+		return
+	}
+	u, path := h.route(r)
+	if u == nil {
+		h.logger.Debug("no route matched", zap.String("host", r.Host), zap.String("path", r.URL.Path))
+		writeError(w, r, h.entry, noRoute)
 		return
 	}
 
 	// Build upstream URL
-	upstreamURL := *h.targetURL
-	upstreamURL.Path = singleJoiningSlash(h.targetURL.Path, r.URL.Path)
+	upstreamURL := *u.target
+	upstreamURL.Path = singleJoiningSlash(u.target.Path, path)
+	upstreamURL.RawPath = ""
 	upstreamURL.RawQuery = r.URL.RawQuery
 
-	// Rewrite request body if it has replaceable content
-	var reqBody io.ReadCloser = r.Body
-	if r.Body != nil && h.reqReplacer != nil {
-		if isTextContentType(r.Header.Get("Content-Type")) {
-			bodyBytes, _ := io.ReadAll(r.Body)
-			if len(bodyBytes) > 0 {
-				replaced := h.reqReplacer.Replace(string(bodyBytes))
-				reqBody = io.NopCloser(strings.NewReader(replaced))
-				r.ContentLength = int64(len(replaced))
-			}
-		}
-	}
-
-	req, err := http.NewRequestWithContext(h.ctx, r.Method, upstreamURL.String(), reqBody)
+	reqBody, contentLength := h.requestBody(r, u)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL.String(), reqBody)
 	if err != nil {
 		h.logger.Error("Request creation failed", zap.Error(err))
-		http.Error(w, "Request creation failed", http.StatusInternalServerError)
+		writeError(w, r, h.entry, internalError)
 		return
 	}
+	req.ContentLength = contentLength
 
 	// Copy headers, with Host rewriting
-	copyHeadersWithReplace(req.Header, r.Header, h.reqReplacer)
-	req.Host = h.targetURL.Host
-	req.Header.Set("Host", h.targetURL.Host)
+	copyHeadersWithReplace(req.Header, r.Header, u.reqReplacer)
+	u.headers.request(req.Header, r.Header)
+	req.Host = u.target.Host
+	req.Header.Set("Host", u.target.Host)
 	req.Header.Set("X-Forwarded-Host", r.Host)
 	req.Header.Set("X-Forwarded-Proto", "http")
+	if len(u.respReplacements) != 0 {
+		// Only ask for encodings the rewriter can decode
+		if accept := decodableAcceptEncoding(req.Header.Get("Accept-Encoding")); accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		} else {
+			req.Header.Del("Accept-Encoding")
+		}
+	}
+	rules := matchRewrites(h.entry, r)
+	rewriteRequest(rules, r, req)
+	if handlePurge(w, r, h.entry, req.URL.String(), h.logger) {
+		return
+	}
 
 	// Transport with optional SOCKS5 dialer
-	dialer, err := proxy.NewDialer(h.entry.Proxy)
+	dialer, err := proxy.NewDialer(u.proxy)
 	if err != nil {
-		http.Error(w, "SOCKS5 dialer error", http.StatusInternalServerError)
+		h.logger.Error("failed to create proxy dialer", zap.Error(err))
+		writeError(w, r, h.entry, proxyChainError)
 		return
 	}
-	transport := &http.Transport{
-		Dial: dialer.Dial,
+	if isUpgradeRequest(r) {
+		keepUpgradeHeaders(req.Header, r.Header)
+		h.handleUpgrade(w, r, req, u.target, dialer.Dial)
+		return
 	}
-	// If you want to allow self-signed backends, add a config flag for this:
-	// transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: h.entry.Insecure}
+	transport := upstreamTransport(h.entry, u.transportKey(), func() *http.Transport {
+		return &http.Transport{
+			Dial:              dialer.Dial,
+			TLSClientConfig:   h.tlsConfig,
+			ForceAttemptHTTP2: h.tlsConfig != nil && slices.Contains(h.tlsConfig.NextProtos, "h2"),
+			IdleConnTimeout:   defaultPoolIdleTimeout,
+		}
+	})
 
 	client := &http.Client{
-		Transport: transport,
+		Transport: cachedTransport(h.entry, transport),
 		Timeout:   h.entry.Timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse // don't follow, let client handle
@@ -187,61 +250,209 @@ func (h *httpToHTTPSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	resp, err := client.Do(req)
 	if err != nil {
 		h.logger.Error("Request to target failed", zap.String("url", upstreamURL.String()), zap.Error(err))
-		http.Error(w, "Request failed", http.StatusBadGateway)
+		writeError(w, r, h.entry, upstreamError(err, false))
 		return
 	}
 	defer resp.Body.Close()
 
+	removeHopHeaders(resp.Header)
+	rewriteResponse(rules, resp.Header)
+	h.writeResponse(w, r, resp, u)
+}
+
+// requestBody returns the request body to send upstream and its length (-1 when unknown).
+// Text bodies of known length are rewritten in memory so the backend still gets a Content-Length,
+// bodies of unknown length are rewritten while streaming and bodies above max_rewrite_size are passed through.
+func (h *httpToHTTPSProxy) requestBody(r *http.Request, u *httpsUpstream) (io.ReadCloser, int64) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return http.NoBody, 0
+	}
+	if len(u.reqReplacements) == 0 || !isTextContentType(r.Header.Get("Content-Type")) || r.ContentLength > h.maxRewriteSize {
+		return r.Body, r.ContentLength
+	}
+	if r.ContentLength < 0 {
+		return readCloser{utils.NewReplaceReader(r.Body, h.maxRewriteSize, u.reqReplacements...), r.Body}, -1
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Debug("request body read failed", zap.Error(err))
+	}
+	replaced := u.reqReplacer.Replace(string(bodyBytes))
+	return io.NopCloser(strings.NewReader(replaced)), int64(len(replaced))
+}
+
+// writeResponse copies the upstream response to the client. Textual bodies are decoded and rewritten while
+// streaming, then optionally re-compressed for the client. Anything else (or larger than max_rewrite_size)
+// is passed through untouched.
+func (h *httpToHTTPSProxy) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, u *httpsUpstream) {
+	var body io.Reader = resp.Body
+	rewrite := len(u.respReplacements) != 0 &&
+		isTextContentType(resp.Header.Get("Content-Type")) &&
+		resp.ContentLength <= h.maxRewriteSize
+	if rewrite {
+		decoded, err := decodeBody(resp)
+		if err != nil {
+			h.logger.Debug("passing response through without rewriting", zap.Error(err))
+			body = resp.Body
+			rewrite = false
+		} else {
+			defer decoded.Close()
+			body = utils.NewReplaceReader(decoded, h.maxRewriteSize, u.respReplacements...)
+		}
+	}
+	var encoding string
+	if rewrite && h.recompress {
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+
 	// Copy response headers with replacement
 	for k, vv := range resp.Header {
-		// Skip hop-by-hop / encoding headers we'll re-compute
-		if strings.EqualFold(k, "Content-Length") || strings.EqualFold(k, "Content-Encoding") {
+		// Rewritten bodies are sent chunked, decoded or in the negotiated encoding
+		if rewrite && (strings.EqualFold(k, "Content-Length") || strings.EqualFold(k, "Content-Encoding")) {
 			continue
 		}
 		for _, v := range vv {
-			w.Header().Add(k, h.respReplacer.Replace(v))
+			if rewritten, ok := u.headers.response(k, v); ok {
+				w.Header().Add(k, rewritten)
+				continue
+			}
+			w.Header().Add(k, u.respReplacer.Replace(v))
 		}
 	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
 
-	// Handle Location redirects
-	if loc := resp.Header.Get("Location"); loc != "" {
-		w.Header().Set("Location", h.respReplacer.Replace(loc))
+	w.WriteHeader(resp.StatusCode)
+	if err := copyEncoded(w, body, encoding, isEventStream(resp.Header.Get("Content-Type"))); err != nil {
+		h.logger.Debug("response copy failed", zap.Error(err))
 	}
+}
 
-	// Read body
-	body, err := io.ReadAll(resp.Body)
+// handleUpgrade relays protocol upgrades (WebSocket, ...) to the backend over a dedicated connection.
+func (h *httpToHTTPSProxy) handleUpgrade(w http.ResponseWriter, r, out *http.Request, target *url.URL, dial func(network, address string) (net.Conn, error)) {
+	connCtx, done := trackConn(h.ctx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, h.entry.GetTimeout())
+	defer cancel()
+
+	port := target.Port()
+	if port == "" {
+		port = "443"
+		if target.Scheme == "http" {
+			port = "80"
+		}
+	}
+	upstream, err := dial("tcp", net.JoinHostPort(target.Hostname(), port))
 	if err != nil {
-		h.logger.Error("Response read failed", zap.Error(err))
-		http.Error(w, "Upstream read failed", http.StatusBadGateway)
+		h.logger.Error("Upgrade dial failed", zap.String("target", target.Host), zap.Error(err))
+		writeError(w, r, h.entry, upstreamError(err, true))
 		return
 	}
+	if target.Scheme != "http" {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if h.tlsConfig != nil {
+			cfg = h.tlsConfig.Clone()
+		}
+		cfg.ServerName = cmp.Or(cfg.ServerName, target.Hostname())
+		// Upgrades are HTTP/1.1 only
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(upstream, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = upstream.Close()
+			h.logger.Error("Upgrade TLS handshake failed", zap.String("target", target.Host), zap.Error(err))
+			writeError(w, r, h.entry, upstreamError(err, true))
+			return
+		}
+		upstream = tlsConn
+	}
+	if err := relayUpgrade(ctx, w, r, out, upstream, h.entry, h.logger, trafficPolicy{}); err != nil {
+		writeError(w, r, h.entry, upstreamError(err, false))
+	}
+}
+
+// httpsOptions are the typed settings of the extra table, replace_host is read separately.
+type httpsOptions struct {
+	// Upstreams selected by host and path, requests matching no route go to the entrypoint target
+	Routes []*httpsRoute `mapstructure:"routes"`
+	// Bodies larger than this are passed through, streams of unknown length stop being rewritten past it
+	MaxRewriteSize int64 `mapstructure:"max_rewrite_size"`
+	// Compress rewritten bodies with the best encoding accepted by the client (br, zstd or gzip)
+	Recompress bool `mapstructure:"recompress"`
+	// TLS client settings towards the backend
+	TLS upstreamTLS `mapstructure:"tls"`
+	// Drop the Secure attribute of cookies so browsers keep them over plain HTTP
+	StripSecureCookies bool `mapstructure:"strip_secure_cookies"`
+}
+
+func decodeHTTPSOptions(extra map[string]any) (httpsOptions, error) {
+	var opts httpsOptions
+	d, err := decoder.Build(&opts)
+	if err != nil {
+		return opts, fmt.Errorf("create decoder: %w", err)
+	}
+	if err := d.Decode(extra); err != nil {
+		return opts, fmt.Errorf("invalid extra config: %w", err)
+	}
+	if opts.MaxRewriteSize <= 0 {
+		opts.MaxRewriteSize = defaultMaxRewriteSize
+	}
+	return opts, nil
+}
 
-	// Decompress if gzipped, then rewrite
-	contentEncoding := resp.Header.Get("Content-Encoding")
-	if strings.Contains(contentEncoding, "gzip") {
-		if gr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
-			uncompressed, _ := io.ReadAll(gr)
-			gr.Close()
-			body = uncompressed
-			// We will serve uncompressed, so don't set Content-Encoding
+// copyEncoded copies body to w, compressed with encoding when set. With flush set (server-sent events)
+// every chunk is flushed to the client as soon as it is written.
+func copyEncoded(w http.ResponseWriter, body io.Reader, encoding string, flush bool) error {
+	rc := http.NewResponseController(w)
+	var dst io.Writer = w
+	flushAll := rc.Flush
+	if encoding != "" {
+		enc, err := newEncoder(w, encoding)
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+		dst = enc
+		flushAll = func() error {
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
 		}
 	}
 
-	if isTextContentType(resp.Header.Get("Content-Type")) && h.respReplacer != nil {
-		body = []byte(h.respReplacer.Replace(string(body)))
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				return wErr
+			}
+			if flush {
+				if fErr := flushAll(); fErr != nil {
+					return fErr
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
-	w.WriteHeader(resp.StatusCode)
-	_, _ = w.Write(body)
+func isEventStream(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	return mediaType == "text/event-stream"
 }
 
 func copyHeadersWithReplace(dst, src http.Header, replacer *strings.Replacer) {
+	src = src.Clone()
+	removeHopHeaders(src)
 	for k, vv := range src {
-		// skip hop-by-hop headers
-		if isHopHeader(k) {
-			continue
-		}
 		for _, v := range vv {
 			if replacer != nil {
 				v = replacer.Replace(v)
@@ -251,16 +462,6 @@ func copyHeadersWithReplace(dst, src http.Header, replacer *strings.Replacer) {
 	}
 }
 
-func isHopHeader(k string) bool {
-	switch strings.ToLower(k) {
-	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization",
-		"te", "trailers", "transfer-encoding", "upgrade", "accept-encoding":
-		return true
-	default:
-		return false
-	}
-}
-
 func isTextContentType(ct string) bool {
 	ct = strings.ToLower(ct)
 	if ct == "" {
@@ -0,0 +1,503 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func newTestHTTPSProxy(t *testing.T, backend *httptest.Server, recompress bool) *httptest.Server {
+	t.Helper()
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := decodeHTTPSOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := newHTTPSUpstream(backend.URL, map[string]string{target.Host: "local.test"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&httpToHTTPSProxy{
+		ctx:            t.Context(),
+		logger:         zap.NewNop(),
+		target:         upstream,
+		maxRewriteSize: opts.MaxRewriteSize,
+		recompress:     recompress,
+	})
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestHTTPToHTTPSStreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: "+backend.Listener.Addr().String()+"\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: done\n\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+	proxy := newTestHTTPSProxy(t, backend, false)
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if l != "data: local.test\n" {
+			t.Errorf("got event %q", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not flushed before the stream ended")
+	}
+}
+
+func TestHTTPToHTTPSRewritesOnlyText(t *testing.T) {
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := backend.Listener.Addr().String()
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = io.WriteString(w, host)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, "<a href=\"http://"+host+"/\">"+strings.Repeat(host, 10000)+"</a>")
+		_ = gz.Close()
+	}))
+	defer backend.Close()
+	proxy := newTestHTTPSProxy(t, backend, false)
+
+	get := func(path string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/")
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Error("rewritten bodies must be served decoded")
+	}
+	if want := "<a href=\"http://local.test/\">" + strings.Repeat("local.test", 10000) + "</a>"; body != want {
+		t.Errorf("text body not rewritten, got %d bytes", len(body))
+	}
+
+	_, body = get("/binary")
+	if body != backend.Listener.Addr().String() {
+		t.Errorf("binary body must pass through untouched, got %q", body)
+	}
+}
+
+func TestHTTPToHTTPSDecodesEncodings(t *testing.T) {
+	var backend *httptest.Server
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "visit http://" + backend.Listener.Addr().String() + "/"
+		var buf bytes.Buffer
+		var enc io.WriteCloser
+		switch coding := r.URL.Query().Get("enc"); coding {
+		case "br":
+			enc = brotli.NewWriter(&buf)
+		case "zstd":
+			enc, _ = zstd.NewWriter(&buf)
+		case "deflate":
+			enc = zlib.NewWriter(&buf)
+		case "raw-deflate":
+			enc, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		case "gzip, br":
+			// Codings are listed in the order they were applied
+			var inner bytes.Buffer
+			gz := gzip.NewWriter(&inner)
+			_, _ = io.WriteString(gz, body)
+			_ = gz.Close()
+			body = inner.String()
+			enc = brotli.NewWriter(&buf)
+		}
+		_, _ = io.WriteString(enc, body)
+		_ = enc.Close()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", strings.TrimPrefix(r.URL.Query().Get("enc"), "raw-"))
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer backend.Close()
+
+	get := func(proxy *httptest.Server, enc, accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/?enc="+url.QueryEscape(enc), nil)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	plain := newTestHTTPSProxy(t, backend, false)
+	for _, enc := range []string{"br", "zstd", "deflate", "raw-deflate", "gzip, br"} {
+		resp, body := get(plain, enc, "br, zstd, gzip, deflate")
+		if resp.Header.Get("Content-Encoding") != "" || string(body) != "visit http://local.test/" {
+			t.Errorf("%s: got %q encoded as %q", enc, body, resp.Header.Get("Content-Encoding"))
+		}
+	}
+
+	recompressing := newTestHTTPSProxy(t, backend, true)
+	resp, body := get(recompressing, "zstd", "gzip;q=0.5, deflate")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := io.ReadAll(gz)
+	if string(decoded) != "visit http://local.test/" {
+		t.Errorf("got %q", decoded)
+	}
+}
+
+func TestHTTPToHTTPSPassesUndecodableBodies(t *testing.T) {
+	var wrapped bytes.Buffer
+	gz := gzip.NewWriter(&wrapped)
+	_, _ = io.WriteString(gz, "compressed with lzw, visit http://example.com/")
+	_ = gz.Close()
+	bodies := map[string][]byte{
+		// The gzip layer is read before the unsupported coding is found
+		"compress, gzip": wrapped.Bytes(),
+		"gzip":           []byte("not gzip, visit http://example.com/"),
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.URL.Query().Get("enc")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", enc)
+		_, _ = w.Write(bodies[enc])
+	}))
+	defer backend.Close()
+	proxy := newTestHTTPSProxy(t, backend, false)
+
+	for enc, want := range bodies {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/?enc="+url.QueryEscape(enc), nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !bytes.Equal(body, want) || resp.Header.Get("Content-Encoding") != enc {
+			t.Errorf("%s: got %q encoded as %q, want the upstream body untouched", enc, body, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                    "",
+		"identity":            "",
+		"gzip, deflate, br":   "br",
+		"gzip;q=1, br;q=0":    "gzip",
+		"*":                   "br",
+		"zstd;q=0.1, deflate": "zstd",
+	}
+	for header, want := range tests {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestHTTPToHTTPSUpstreamTLS(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto+" "+r.TLS.ServerName)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := decodeHTTPSOptions(map[string]any{
+		"tls": map[string]any{
+			"ca":          ca,
+			"server_name": "example.com",
+			"min_version": "1.3",
+			"alpn":        []string{"h2", "http/1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := opts.TLS.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := newHTTPSUpstream(backend.URL, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&httpToHTTPSProxy{
+		ctx:            t.Context(),
+		logger:         zap.NewNop(),
+		target:         upstream,
+		maxRewriteSize: opts.MaxRewriteSize,
+		tlsConfig:      tlsConfig,
+	})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0 example.com" {
+		t.Errorf("got %q (status %d)", body, resp.StatusCode)
+	}
+
+	for _, invalid := range []upstreamTLS{{MinVersion: "1.4"}, {Cert: "client.pem"}, {CA: filepath.Join(t.TempDir(), "missing.pem")}} {
+		if _, err := invalid.config(); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestHTTPToHTTPSRoutes(t *testing.T) {
+	echo := func(name string) *httptest.Server {
+		var backend *httptest.Server
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.URL.Path+" "+backend.Listener.Addr().String())
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+	users, orders, fallback := echo("users"), echo("orders"), echo("fallback")
+	entry := config.EntryPoint{
+		Target: fallback.URL,
+		ExtraConf: map[string]any{
+			"routes": []any{
+				map[string]any{
+					"path_prefix":  "/users",
+					"strip_prefix": true,
+					"to":           users.URL + "/v2",
+					"replace_host": map[string]any{users.Listener.Addr().String(): "users.local"},
+				},
+				map[string]any{
+					"path":         "^/orders/[0-9]+",
+					"strip_prefix": true,
+					"to":           orders.URL,
+				},
+			},
+		},
+	}
+	h, err := newHTTPToHTTPSProxy(t.Context(), entry, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	tests := map[string]string{
+		"/users/42":       "users /v2/42 users.local",
+		"/orders/7/items": "orders /items " + orders.Listener.Addr().String(),
+		"/orders/abc":     "fallback /orders/abc " + fallback.Listener.Addr().String(),
+		"/usersettings":   "fallback /usersettings " + fallback.Listener.Addr().String(),
+	}
+	for path, want := range tests {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: got %q, want %q", path, body, want)
+		}
+	}
+
+	if _, err := newHTTPToHTTPSProxy(t.Context(), config.EntryPoint{}, zap.NewNop()); err == nil {
+		t.Error("expected an entrypoint without target and routes to be rejected")
+	}
+}
+
+func TestHTTPToHTTPSCacheAndPurge(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, strconv.Itoa(int(hits.Add(1))))
+	}))
+	defer backend.Close()
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	entry := config.EntryPoint{
+		Target: backend.URL,
+		Cache:  &config.Cache{PurgeFrom: []*config.AddrMatcher{{Prefix: &loopback}}},
+	}
+	if err := SetupCaches(t.Context(), []config.EntryPoint{entry}); err != nil {
+		t.Fatal(err)
+	}
+	defer Reset()
+	h, err := newHTTPToHTTPSProxy(t.Context(), entry, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	do := func(method string) (string, string) {
+		req, _ := http.NewRequest(method, proxy.URL+"/app.js", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), resp.Header.Get("Cache-Status")
+	}
+	do(http.MethodGet)
+	if body, status := do(http.MethodGet); body != "1" || status != "junction; hit" {
+		t.Errorf("expected a cache hit, got %q (%s)", body, status)
+	}
+	if body, _ := do(methodPurge); body != "Purged 1\n" {
+		t.Errorf("purge: got %q", body)
+	}
+	if body, _ := do(http.MethodGet); body != "2" {
+		t.Errorf("expected the purged response to be fetched again, got %q", body)
+	}
+}
+
+func TestHandlePurgeErrors(t *testing.T) {
+	defer Reset()
+	cached := config.EntryPoint{Cache: &config.Cache{}}
+	if err := SetupCaches(t.Context(), []config.EntryPoint{cached}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		entry  config.EntryPoint
+		status int
+		code   string
+	}{
+		{config.EntryPoint{}, http.StatusNotFound, codeCacheDisabled},
+		{cached, http.StatusForbidden, codePurgeDenied},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(methodPurge, "http://example.com/app.js", nil)
+		if !handlePurge(w, r, tt.entry, r.URL.String(), zap.NewNop()) {
+			t.Fatal("expected PURGE to be handled")
+		}
+		if w.Code != tt.status || w.Header().Get(errorHeader) != tt.code || w.Header().Get(requestIDHeader) == "" {
+			t.Errorf("got %d %q, want %d %q", w.Code, w.Header().Get(errorHeader), tt.status, tt.code)
+		}
+	}
+}
+
+func TestHTTPToHTTPSReusesUpstreamConnections(t *testing.T) {
+	defer Reset()
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	proxy := newTestHTTPSProxy(t, backend, false)
+
+	for range 3 {
+		resp, err := http.Get(proxy.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+}
+
+func TestHTTPToHTTPSRouteTransportPerProxy(t *testing.T) {
+	defer Reset()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	entry := config.EntryPoint{
+		ExtraConf: map[string]any{
+			"routes": []any{
+				map[string]any{"path_prefix": "/direct", "to": backend.URL},
+				// Nothing listens on the proxy, requests of this route must fail
+				map[string]any{"path_prefix": "/proxied", "to": backend.URL, "proxy": []*url.URL{{Scheme: "socks5", Host: "127.0.0.1:1"}}},
+			},
+		},
+	}
+	h, err := newHTTPToHTTPSProxy(t.Context(), entry, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	// The direct route goes first so a shared transport would carry the proxied request too
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{{"/direct", http.StatusOK}, {"/proxied", http.StatusBadGateway}} {
+		resp, err := http.Get(proxy.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
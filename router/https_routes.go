@@ -0,0 +1,166 @@
+package router
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/fmotalleb/go-tools/matcher"
+)
+
+// httpsUpstream is a backend of an http-to-https entrypoint together with the rewriters of its replace_host map.
+type httpsUpstream struct {
+	target *url.URL
+	proxy  []*url.URL
+	// reqReplacer: local -> upstream, respReplacer: upstream -> local
+	reqReplacer  *strings.Replacer
+	respReplacer *strings.Replacer
+	// Replacement pairs of the streaming body rewriters
+	reqReplacements  []string
+	respReplacements []string
+	headers          *headerRewriter
+}
+
+// newHTTPSUpstream builds the upstream of target, replaceHost maps upstream hosts to local ones.
+func newHTTPSUpstream(target string, replaceHost map[string]string, proxy []*url.URL, stripSecure bool) (*httpsUpstream, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL: %w", err)
+	}
+	if targetURL.Scheme == "" || targetURL.Host == "" {
+		return nil, fmt.Errorf("invalid target URL %q, expected e.g. https://google.com", target)
+	}
+	u := &httpsUpstream{target: targetURL, proxy: proxy}
+	// Longer hosts first, so api.example.com is not rewritten as a suffix of example.com
+	upstreams := make([]string, 0, len(replaceHost))
+	for upstream, local := range replaceHost {
+		if upstream != "" && local != "" {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	slices.SortFunc(upstreams, func(a, b string) int {
+		return cmp.Or(len(b)-len(a), strings.Compare(a, b))
+	})
+	for _, upstream := range upstreams {
+		local := replaceHost[upstream]
+		// request: client sends local, we send upstream
+		u.reqReplacements = append(u.reqReplacements, local, upstream)
+		// response: backend sends upstream, we send local
+		u.respReplacements = append(u.respReplacements, upstream, local)
+	}
+	u.reqReplacer = strings.NewReplacer(u.reqReplacements...)
+	u.respReplacer = strings.NewReplacer(u.respReplacements...)
+	u.headers = newHeaderRewriter(u.respReplacements, targetURL.Scheme, stripSecure)
+	return u, nil
+}
+
+// transportKey identifies the connections of the upstream, routes to one host through different proxy chains
+// must not share them.
+func (u *httpsUpstream) transportKey() string {
+	chain := make([]string, len(u.proxy))
+	for i, p := range u.proxy {
+		chain[i] = p.String()
+	}
+	return u.target.Scheme + "://" + u.target.Host + "|" + strings.Join(chain, ",")
+}
+
+// parseReplaceHost reads the replace_host table of the extra config.
+func parseReplaceHost(extra map[string]any) (map[string]string, error) {
+	replaceHosts, ok := extra["replace_host"]
+	if !ok {
+		return nil, nil
+	}
+	var replaceMap map[string]any
+	if replaceMap, ok = replaceHosts.(map[string]any); !ok {
+		return nil, errors.New("invalid replace map structure, expected string -> string map")
+	}
+	hosts := make(map[string]string, len(replaceMap))
+	for upstream, localAddr := range replaceMap {
+		var local string
+		if local, ok = localAddr.(string); !ok {
+			return nil, errors.New("invalid replace map structure, expected string -> string map, right side does not look like a string")
+		}
+		hosts[upstream] = local
+	}
+	return hosts, nil
+}
+
+// httpsRoute sends the requests matching its host and path to a dedicated upstream.
+type httpsRoute struct {
+	// Empty Hosts matches every host
+	Hosts []*matcher.Matcher `mapstructure:"hosts"`
+	// Path prefix matched on segment boundaries (/api matches /api and /api/x, not /apix) and regular expression,
+	// both must match when set
+	PathPrefix string `mapstructure:"path_prefix"`
+	Path       string `mapstructure:"path"`
+	// Remove path_prefix (or the leading match of path) before joining the path to the upstream URL
+	StripPrefix bool   `mapstructure:"strip_prefix"`
+	Target      string `mapstructure:"to"`
+	// map[upstream_host]local_host of this upstream, the entrypoint replace_host is not inherited
+	ReplaceHost map[string]string `mapstructure:"replace_host"`
+	// SOCKS5 chain of this upstream, defaults to the entrypoint proxy
+	Proxy []*url.URL `mapstructure:"proxy"`
+
+	path     *regexp.Regexp
+	upstream *httpsUpstream
+}
+
+// compile prepares the path expression and the upstream of the route.
+func (r *httpsRoute) compile(proxy []*url.URL, stripSecure bool) error {
+	if r.Path != "" {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return fmt.Errorf("invalid route path %q: %w", r.Path, err)
+		}
+		r.path = re
+	}
+	if len(r.Proxy) != 0 {
+		proxy = r.Proxy
+	}
+	u, err := newHTTPSUpstream(r.Target, r.ReplaceHost, proxy, stripSecure)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", r.Target, err)
+	}
+	r.upstream = u
+	return nil
+}
+
+// match reports whether the route applies to host (without port) and path,
+// and returns the path to send upstream.
+func (r *httpsRoute) match(host, path string) (string, bool) {
+	if len(r.Hosts) != 0 && !slices.ContainsFunc(r.Hosts, func(m *matcher.Matcher) bool { return m.Match(host) }) {
+		return "", false
+	}
+	if !hasPathPrefix(path, r.PathPrefix) {
+		return "", false
+	}
+	var loc []int
+	if r.path != nil {
+		if loc = r.path.FindStringIndex(path); loc == nil {
+			return "", false
+		}
+	}
+	if !r.StripPrefix {
+		return path, true
+	}
+	switch {
+	case r.PathPrefix != "":
+		path = strings.TrimPrefix(path, r.PathPrefix)
+	case loc != nil && loc[0] == 0:
+		path = path[loc[1]:]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, true
+}
+
+// hasPathPrefix reports whether prefix is a leading run of whole segments of path.
+func hasPathPrefix(path, prefix string) bool {
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || prefix == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/')
+}
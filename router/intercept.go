@@ -0,0 +1,105 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/fmotalleb/go-tools/log"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/intercept"
+	"github.com/fmotalleb/junction/utils"
+)
+
+var (
+	interceptMu  sync.Mutex
+	interceptors = map[*config.Intercept]*intercept.Interceptor{}
+)
+
+func init() {
+	registerReset(func() {
+		interceptMu.Lock()
+		defer interceptMu.Unlock()
+		for _, i := range interceptors {
+			_ = i.Close()
+		}
+		interceptors = make(map[*config.Intercept]*intercept.Interceptor)
+	})
+}
+
+// SetupInterception creates the interceptors of the entries, invalid interception configs are reported before any listener starts.
+func SetupInterception(ctx context.Context, entries []config.EntryPoint) error {
+	interceptMu.Lock()
+	defer interceptMu.Unlock()
+	for _, e := range entries {
+		if e.Intercept == nil || interceptors[e.Intercept] != nil {
+			continue
+		}
+		logger := log.FromContext(ctx).Named("router.intercept").With(zap.String("listen", e.Listen.String()))
+		i, err := intercept.New(e.Intercept, logger)
+		if err != nil {
+			return err
+		}
+		interceptors[e.Intercept] = i
+	}
+	return nil
+}
+
+// interceptorFor returns the interceptor of entry if the host is allow-listed for interception.
+func interceptorFor(entry config.EntryPoint, host string) (*intercept.Interceptor, bool) {
+	if entry.Intercept == nil {
+		return nil, false
+	}
+	interceptMu.Lock()
+	i := interceptors[entry.Intercept]
+	interceptMu.Unlock()
+	if i == nil || !i.Matches(host) {
+		return nil, false
+	}
+	return i, true
+}
+
+// interceptConn hands the client connection to the interceptor, data already read from the client is replayed first.
+func interceptConn(parentCtx context.Context, i *intercept.Interceptor, client net.Conn, data []byte, host, port string, dial func(network, address string) (net.Conn, error), logger *zap.Logger, entry config.EntryPoint, buckets []*utils.Bucket) {
+	connCtx, done := trackConn(parentCtx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, entry.GetTimeout())
+	defer cancel()
+
+	logger.Debug("intercepting connection", zap.String("host", host))
+	conn := &shapedConn{
+		Conn:    client,
+		r:       utils.LimitReader(ctx, io.MultiReader(bytes.NewReader(data), client), buckets...),
+		ctx:     ctx,
+		buckets: buckets,
+	}
+	if err := i.Serve(ctx, conn, host, port, dial); err != nil {
+		logger.Debug("interception failed", zap.String("host", host), zap.Error(err))
+	}
+	_ = client.Close()
+}
+
+// shapedConn replays buffered client data and throttles both directions with buckets.
+type shapedConn struct {
+	net.Conn
+	r       io.Reader
+	ctx     context.Context
+	buckets []*utils.Bucket
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	for _, b := range c.buckets {
+		if err := b.Wait(c.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
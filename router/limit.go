@@ -0,0 +1,183 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+var (
+	errEntryLimit  = errors.New("entrypoint connection limit reached")
+	errClientLimit = errors.New("client connection limit reached")
+)
+
+// connLimiter enforces max_connections and max_client_connections of an entrypoint.
+// When the entrypoint is full, new connections wait up to queue_timeout for a free slot before being rejected.
+type connLimiter struct {
+	slots        chan struct{} // nil when unlimited
+	perClient    int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	clients  map[string]int
+	rejected atomic.Uint64
+}
+
+func newConnLimiter(entry config.EntryPoint) *connLimiter {
+	l := &connLimiter{
+		perClient:    entry.MaxClientConnections,
+		queueTimeout: entry.QueueTimeout,
+		clients:      make(map[string]int),
+	}
+	if entry.MaxConnections > 0 {
+		l.slots = make(chan struct{}, entry.MaxConnections)
+	}
+	return l
+}
+
+// acquire reserves a slot for the client, the returned function releases it.
+func (l *connLimiter) acquire(ctx context.Context, client string) (func(), error) {
+	if err := l.acquireClient(client); err != nil {
+		return nil, err
+	}
+	if err := l.acquireSlot(ctx); err != nil {
+		l.releaseClient(client)
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if l.slots != nil {
+				<-l.slots
+			}
+			l.releaseClient(client)
+		})
+	}, nil
+}
+
+func (l *connLimiter) acquireClient(client string) error {
+	if l.perClient <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client] >= l.perClient {
+		return errClientLimit
+	}
+	l.clients[client]++
+	return nil
+}
+
+func (l *connLimiter) releaseClient(client string) {
+	if l.perClient <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client] <= 1 {
+		delete(l.clients, client)
+		return
+	}
+	l.clients[client]--
+}
+
+func (l *connLimiter) acquireSlot(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return errEntryLimit
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errEntryLimit
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reject counts and logs a rejected connection.
+func (l *connLimiter) reject(logger *zap.Logger, client string, reason error) {
+	total := l.rejected.Add(1)
+	logger.Warn("connection rejected by admission control",
+		zap.String("client", client),
+		zap.Uint64("rejected", total),
+		zap.Error(reason),
+	)
+}
+
+// limitedListener applies a connLimiter to every accepted connection,
+// rejected connections are closed before being handed to the router.
+type limitedListener struct {
+	net.Listener
+	ctx     context.Context
+	limiter *connLimiter
+	logger  *zap.Logger
+}
+
+func limitListener(ctx context.Context, ln net.Listener, entry config.EntryPoint, logger *zap.Logger) net.Listener {
+	if entry.MaxConnections <= 0 && entry.MaxClientConnections <= 0 {
+		return ln
+	}
+	return &limitedListener{
+		Listener: ln,
+		ctx:      ctx,
+		limiter:  newConnLimiter(entry),
+		logger:   logger,
+	}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		client := clientIP(conn.RemoteAddr())
+		release, err := l.limiter.acquire(l.ctx, client)
+		if err != nil {
+			l.limiter.reject(l.logger, client, err)
+			_ = conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: release}, nil
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// clientIP returns the host part of the address, or the address itself if it has no port.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	raw := addr.String()
+	if host, _, err := net.SplitHostPort(raw); err == nil && host != "" {
+		return host
+	}
+	return raw
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestConnLimiterPerClient(t *testing.T) {
+	l := newConnLimiter(config.EntryPoint{MaxClientConnections: 1})
+
+	release, err := l.acquire(context.Background(), "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = l.acquire(context.Background(), "10.0.0.1"); !errors.Is(err, errClientLimit) {
+		t.Fatalf("expected client limit error, got %v", err)
+	}
+	if _, err = l.acquire(context.Background(), "10.0.0.2"); err != nil {
+		t.Fatalf("other clients must not be affected: %v", err)
+	}
+	release()
+	release()
+	if _, err = l.acquire(context.Background(), "10.0.0.1"); err != nil {
+		t.Fatalf("slot must be free after release: %v", err)
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	l := newConnLimiter(config.EntryPoint{MaxConnections: 1})
+	release, err := l.acquire(context.Background(), "10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = l.acquire(context.Background(), "10.0.0.2"); !errors.Is(err, errEntryLimit) {
+		t.Fatalf("expected entry limit error without queue, got %v", err)
+	}
+
+	l.queueTimeout = time.Second
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	if _, err = l.acquire(context.Background(), "10.0.0.2"); err != nil {
+		t.Fatalf("queued connection must get the released slot: %v", err)
+	}
+}
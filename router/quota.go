@@ -0,0 +1,42 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/quota"
+	"github.com/fmotalleb/junction/utils"
+)
+
+// trafficPolicy bundles the throttling and accounting applied to a single request.
+type trafficPolicy struct {
+	buckets []*utils.Bucket
+	meter   *quota.Meter
+}
+
+func (p trafficPolicy) reader(ctx context.Context, r io.Reader) io.Reader {
+	return p.meter.Reader(utils.LimitReader(ctx, r, p.buckets...))
+}
+
+// newMeter returns the quota meter of the client, quota.ErrQuotaExceeded is returned if a blocking quota is exhausted.
+func newMeter(ctx context.Context, entry config.EntryPoint, client net.Addr) (*quota.Meter, error) {
+	m := quota.NewMeter(connContext(ctx), quota.Current(), entry.Quotas, net.ParseIP(clientIP(client)))
+	if m == nil {
+		return nil, nil
+	}
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// meterConn charges traffic of conn to the quotas of entry, quota.ErrQuotaExceeded is returned if a blocking quota is exhausted.
+func meterConn(ctx context.Context, conn net.Conn, entry config.EntryPoint) (net.Conn, error) {
+	m, err := newMeter(ctx, entry, conn.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	return quota.WrapConn(conn, m), nil
+}
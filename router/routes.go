@@ -0,0 +1,113 @@
+package router
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/proxy"
+)
+
+const unixBackendPrefix = "unix:"
+
+// backend is a statically routed upstream of an entrypoint.
+type backend struct {
+	network string // tcp or unix
+	address string
+}
+
+// routeBackend returns the backend of the route matching name, defPort is used when the route has no port.
+func routeBackend(entry config.EntryPoint, name, defPort string) (backend, bool) {
+	raw, ok := entry.RouteFor(name)
+	if !ok || raw == "" {
+		return backend{}, false
+	}
+	return parseBackend(raw, defPort), true
+}
+
+// fallbackEntry returns the entrypoint whose fallback serves the client: the entrypoint itself,
+// or the first member of its tag group that has a fallback and accepts the client.
+func fallbackEntry(entry config.EntryPoint, group []config.EntryPoint, client net.Addr) (config.EntryPoint, bool) {
+	if entry.Tag == nil {
+		group = []config.EntryPoint{entry}
+	}
+	for _, ep := range group {
+		if ep.Fallback != "" && ep.AllowedFrom(client) {
+			return ep, true
+		}
+	}
+	return entry, false
+}
+
+// parseBackend parses "unix:/path", "host:port" or "host" (using defPort) backend addresses.
+func parseBackend(raw, defPort string) backend {
+	if path, ok := strings.CutPrefix(raw, unixBackendPrefix); ok {
+		return backend{network: "unix", address: path}
+	}
+	if _, _, err := net.SplitHostPort(raw); err != nil && defPort != "" {
+		raw = net.JoinHostPort(raw, defPort)
+	}
+	return backend{network: "tcp", address: raw}
+}
+
+func (b backend) String() string {
+	if b.network == "unix" {
+		return unixBackendPrefix + b.address
+	}
+	return b.address
+}
+
+// dial connects to the backend through the proxy chain of entry, unix sockets are always dialed locally.
+// Backends are configured by the operator, so the destination policy does not apply.
+func (b backend) dial(ctx context.Context, entry config.EntryPoint, logger *zap.Logger) (net.Conn, error) {
+	if b.network == "unix" {
+		conn, err := new(net.Dialer).DialContext(ctx, "unix", b.address)
+		if err != nil {
+			logger.Debug("failed to connect to backend", zap.String("backend", b.String()), zap.Error(err))
+		}
+		return conn, err
+	}
+	dialer, err := proxy.NewDialer(entry.Proxy)
+	if err != nil {
+		logger.Error("failed to create SOCKS5 dialer", zap.Error(err))
+		return nil, err
+	}
+	conn, err := dialer.Dial("tcp", b.address)
+	if err != nil {
+		logger.Debug("failed to connect to backend", zap.String("backend", b.String()), zap.Error(err))
+	}
+	return conn, err
+}
+
+// dialer returns the backend as a dial function ignoring the dialed address.
+func (b backend) dialer(ctx context.Context, entry config.EntryPoint, logger *zap.Logger) func(network, address string) (net.Conn, error) {
+	return func(_, _ string) (net.Conn, error) {
+		return b.dial(ctx, entry, logger)
+	}
+}
+
+// targetDialer returns the dial function used for a client chosen name. Names matching a static route
+// are sent to its backend regardless of the dialed address, the rest go through the destination policy.
+func targetDialer(ctx context.Context, entry config.EntryPoint, name, defPort string, logger *zap.Logger) (func(network, address string) (net.Conn, error), error) {
+	if b, ok := routeBackend(entry, name, defPort); ok {
+		logger.Debug("static route matched", zap.String("hostname", name), zap.String("backend", b.String()))
+		return b.dialer(ctx, entry, logger), nil
+	}
+	dialer, err := newGuardedDialer(entry, logger)
+	if err != nil {
+		logger.Error("failed to create SOCKS5 dialer", zap.Error(err))
+		return nil, err
+	}
+	return dialer.Dial, nil
+}
+
+// portOr returns the port of hostPort or def when it has none.
+func portOr(hostPort, def string) string {
+	if _, port, err := net.SplitHostPort(hostPort); err == nil && port != "" {
+		return port
+	}
+	return def
+}
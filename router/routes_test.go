@@ -0,0 +1,43 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		raw     string
+		network string
+		address string
+	}{
+		{"10.0.0.1:8443", "tcp", "10.0.0.1:8443"},
+		{"decoy.internal", "tcp", "decoy.internal:443"},
+		{"unix:/run/decoy.sock", "unix", "/run/decoy.sock"},
+	}
+	for _, tt := range tests {
+		b := parseBackend(tt.raw, "443")
+		if b.network != tt.network || b.address != tt.address {
+			t.Errorf("parseBackend(%q) = %s %s, want %s %s", tt.raw, b.network, b.address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestFallbackEntryGroup(t *testing.T) {
+	tag := "edge"
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	group := []config.EntryPoint{
+		{Tag: &tag},
+		{Tag: &tag, Fallback: "127.0.0.1:9443"},
+	}
+
+	ep, ok := fallbackEntry(group[0], group, client)
+	if !ok || ep.Fallback != "127.0.0.1:9443" {
+		t.Fatalf("expected the group fallback, got %q (ok=%v)", ep.Fallback, ok)
+	}
+	if _, ok = fallbackEntry(config.EntryPoint{}, nil, client); ok {
+		t.Fatal("entry without fallback must not match")
+	}
+}
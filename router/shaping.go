@@ -0,0 +1,196 @@
+package router
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/utils"
+)
+
+const (
+	minBandwidthBurst = 16 * 1024
+	bucketIdleTTL     = 10 * time.Minute
+	bucketSweepEvery  = 1024
+)
+
+type rateScopeKind string
+
+const (
+	scopeEntry  rateScopeKind = "entry"
+	scopeClient rateScopeKind = "client"
+	scopeHost   rateScopeKind = "host"
+)
+
+// rateScope identifies a single rate limit applied to a connection.
+type rateScope struct {
+	base  string // identity of the entrypoint, stable across reloads
+	kind  rateScopeKind
+	id    string // client ip or index of host rate limit
+	limit *config.RateLimit
+}
+
+func (s rateScope) key() string {
+	return s.base + "|" + string(s.kind) + "|" + s.id
+}
+
+type registeredBucket struct {
+	bucket    *utils.Bucket
+	scope     rateScope
+	bandwidth bool
+}
+
+// Buckets are kept across config reloads so open relays pick up the new rates.
+var (
+	bucketsMu     sync.Mutex
+	buckets       = make(map[string]*registeredBucket)
+	bucketInserts int
+)
+
+// entryKey identifies an entrypoint by listener, target and proxy chain.
+func entryKey(e config.EntryPoint) string {
+	proxies := make([]string, len(e.Proxy))
+	for i, p := range e.Proxy {
+		proxies[i] = (&url.URL{Scheme: p.Scheme, Host: p.Host, Path: p.Path}).String()
+	}
+	return e.Listen.String() + "|" + e.Target + "|" + strings.Join(proxies, ",")
+}
+
+// rateScopes lists the rate limits of the entry that apply to the client and host (empty if unknown).
+func rateScopes(entry config.EntryPoint, client, host string) []rateScope {
+	if entry.RateLimit == nil && entry.ClientRateLimit == nil && len(entry.HostRateLimits) == 0 {
+		return nil
+	}
+	base := entryKey(entry)
+	scopes := make([]rateScope, 0, 2)
+	if entry.RateLimit != nil {
+		scopes = append(scopes, rateScope{base: base, kind: scopeEntry, limit: entry.RateLimit})
+	}
+	if entry.ClientRateLimit != nil {
+		scopes = append(scopes, rateScope{base: base, kind: scopeClient, id: client, limit: entry.ClientRateLimit})
+	}
+	if host != "" {
+		for i, l := range entry.HostRateLimits {
+			if l.MatchHost(host) {
+				scopes = append(scopes, rateScope{base: base, kind: scopeHost, id: strconv.Itoa(i), limit: l})
+			}
+		}
+	}
+	return scopes
+}
+
+// admitConn takes a token from the connection rate bucket of every scope,
+// false means the connection exceeds one of the connections per second limits.
+func admitConn(scopes []rateScope) bool {
+	for _, s := range scopes {
+		if s.limit.Connections <= 0 {
+			continue
+		}
+		if !sharedBucket(s, false).Allow() {
+			return false
+		}
+	}
+	return true
+}
+
+// bandwidthBuckets returns the bandwidth buckets to throttle the relay with.
+func bandwidthBuckets(scopes []rateScope) []*utils.Bucket {
+	var result []*utils.Bucket
+	for _, s := range scopes {
+		if s.limit.Bandwidth <= 0 {
+			continue
+		}
+		result = append(result, sharedBucket(s, true))
+	}
+	return result
+}
+
+func bucketRate(l *config.RateLimit, bandwidth bool) (float64, int) {
+	if l == nil {
+		return 0, 0
+	}
+	if bandwidth {
+		return float64(l.Bandwidth), max(int(l.Bandwidth), minBandwidthBurst)
+	}
+	return l.Connections, int(math.Ceil(l.Connections))
+}
+
+func sharedBucket(s rateScope, bandwidth bool) *utils.Bucket {
+	key := s.key()
+	if bandwidth {
+		key = "bandwidth|" + key
+	} else {
+		key = "connections|" + key
+	}
+	rate, burst := bucketRate(s.limit, bandwidth)
+
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	if b, ok := buckets[key]; ok {
+		return b.bucket
+	}
+	b := &registeredBucket{
+		bucket:    utils.NewBucket(rate, burst),
+		scope:     s,
+		bandwidth: bandwidth,
+	}
+	buckets[key] = b
+	bucketInserts++
+	if bucketInserts%bucketSweepEvery == 0 {
+		sweepIdleBuckets()
+	}
+	return b.bucket
+}
+
+// sweepIdleBuckets forgets per client buckets that were not used for a while, caller must hold bucketsMu.
+func sweepIdleBuckets() {
+	deadline := time.Now().Add(-bucketIdleTTL)
+	for key, b := range buckets {
+		if b.scope.kind == scopeClient && b.bucket.IdleSince(deadline) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// ApplyRateLimits updates the rates of existing buckets using the new configuration,
+// buckets of removed limits are made unlimited so open relays are not throttled by stale rules.
+func ApplyRateLimits(entries []config.EntryPoint) {
+	byKey := make(map[string]config.EntryPoint, len(entries))
+	for _, e := range entries {
+		byKey[entryKey(e)] = e
+	}
+
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	for key, b := range buckets {
+		var limit *config.RateLimit
+		if e, ok := byKey[b.scope.base]; ok {
+			limit = scopeLimit(e, b.scope)
+		}
+		rate, burst := bucketRate(limit, b.bandwidth)
+		b.bucket.SetRate(rate, burst)
+		if limit == nil {
+			delete(buckets, key)
+			continue
+		}
+		b.scope.limit = limit
+	}
+}
+
+func scopeLimit(e config.EntryPoint, s rateScope) *config.RateLimit {
+	switch s.kind {
+	case scopeEntry:
+		return e.RateLimit
+	case scopeClient:
+		return e.ClientRateLimit
+	case scopeHost:
+		if i, err := strconv.Atoi(s.id); err == nil && i < len(e.HostRateLimits) {
+			return e.HostRateLimits[i]
+		}
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package router
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	"sync"
 
@@ -11,10 +13,18 @@ import (
 
 	"github.com/fmotalleb/junction/config"
 	"github.com/fmotalleb/junction/crypto/tls"
+	"github.com/fmotalleb/junction/utils"
 )
 
 const DefaultSNIPort = "443"
 
+const (
+	helloRecordHeader    = 5
+	helloRecordHandshake = 0x16
+	// A record carries at most 2^14 bytes of plaintext
+	maxHelloRecord = helloRecordHeader + 1<<14
+)
+
 var (
 	sniGroups     = make(map[string][]config.EntryPoint, 0)
 	groupMu       sync.Mutex
@@ -67,11 +77,12 @@ func serveSNIRouter(ctx context.Context, entry config.EntryPoint) error {
 		)
 
 	addr := net.TCPAddrFromAddrPort(entry.Listen)
-	listener, err := net.ListenTCP("tcp", addr)
+	tcpListener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		logger.Error("listen failed", zap.String("addr", entry.Listen.String()), zap.Error(err))
 		return err
 	}
+	listener := limitListener(ctx, tcpListener, entry, logger)
 	defer listener.Close()
 
 	logger.Info("SNI router started")
@@ -107,14 +118,28 @@ func handleClient(ctx context.Context, conn net.Conn, entry config.EntryPoint, l
 		}
 	}
 
-	serverName, buf, n, err := readSNI(conn, logger)
+	hello, buf, n, err := readHello(conn, logger)
 	if err != nil {
+		if errors.Is(err, errSNIMissing) && serveFallback(ctx, conn, buf[:n], logger, entry) {
+			return
+		}
 		_ = conn.Close()
 		return
 	}
 
-	sni := string(serverName)
-	l := logger.With(zap.String("sni", sni))
+	sni := string(hello.ServerName())
+	alpn := helloProtocols(hello)
+	ja3, ja4 := helloFingerprints(hello)
+	l := logger.With(
+		zap.String("sni", sni),
+		zap.Strings("alpn", alpn),
+		zap.String("ja3", ja3),
+		zap.String("ja4", ja4),
+		zap.Bool("ech", hello.ECH),
+	)
+	if hello.ECH {
+		l = l.With(zap.ByteString("public_name", hello.PublicName()))
+	}
 
 	if entry.Tag == nil {
 		if !entry.Allowed(sni) {
@@ -122,25 +147,116 @@ func handleClient(ctx context.Context, conn net.Conn, entry config.EntryPoint, l
 			_ = conn.Close()
 			return
 		}
-		go proxyToTarget(ctx, conn, sni, buf, n, l, entry)
+		if hello.Version == 0 && inspectsHello(entry) {
+			l.Warn("unparsed ClientHello rejected")
+			_ = conn.Close()
+			return
+		}
+		if !entry.AllowedALPN(alpn) {
+			l.Warn("ALPN rejected")
+			_ = conn.Close()
+			return
+		}
+		if !entry.AllowedFingerprint(ja3, ja4) {
+			l.Warn("fingerprint rejected")
+			_ = conn.Close()
+			return
+		}
+		if !entry.AllowedECH(hello.ECH) {
+			l.Warn("ECH policy rejected")
+			_ = conn.Close()
+			return
+		}
+		admitSNIClient(ctx, conn, sni, buf, n, l, entry)
 		return
 	}
 
 	// Tagged routing
 	for _, ep := range sniGroups[*entry.Tag] {
-		if ep.Allowed(sni) && ep.AllowedFrom(remote) {
-			go proxyToTarget(ctx, conn, sni, buf, n, l, ep)
+		if acceptsHello(ep, hello, sni, alpn, ja3, ja4) && ep.AllowedFrom(remote) {
+			admitSNIClient(ctx, conn, sni, buf, n, l, ep)
 			return
 		}
 	}
 
 	l.Warn("no matching entry for SNI")
+	if serveFallback(ctx, conn, buf[:n], l, entry) {
+		return
+	}
 	_ = conn.Close()
 }
 
+// admitSNIClient applies the rate limits of the selected entry before proxying the connection.
+func admitSNIClient(ctx context.Context, conn net.Conn, sni string, buf []byte, n int, logger *zap.Logger, entry config.EntryPoint) {
+	metered, buckets, ok := admitClient(ctx, conn, sni, logger, entry)
+	if !ok {
+		return
+	}
+	go proxyToTarget(ctx, metered, sni, buf, n, logger, entry, buckets)
+}
+
+// admitClient checks the rate limits and quotas of entry, the connection is closed when rejected.
+func admitClient(ctx context.Context, conn net.Conn, host string, logger *zap.Logger, entry config.EntryPoint) (net.Conn, []*utils.Bucket, bool) {
+	scopes := rateScopes(entry, clientIP(conn.RemoteAddr()), host)
+	if !admitConn(scopes) {
+		logger.Warn("connection rate limit exceeded", zap.String("client", conn.RemoteAddr().String()))
+		_ = conn.Close()
+		return nil, nil, false
+	}
+	metered, err := meterConn(ctx, conn, entry)
+	if err != nil {
+		logger.Warn("connection rejected", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+		_ = conn.Close()
+		return nil, nil, false
+	}
+	return metered, bandwidthBuckets(scopes), true
+}
+
+// serveFallback relays a connection that cannot be routed by name to the fallback backend,
+// replaying the bytes already read from the client. It reports false when no fallback applies.
+func serveFallback(ctx context.Context, conn net.Conn, data []byte, logger *zap.Logger, entry config.EntryPoint) bool {
+	var group []config.EntryPoint
+	if entry.Tag != nil {
+		group = sniGroups[*entry.Tag]
+	}
+	ep, ok := fallbackEntry(entry, group, conn.RemoteAddr())
+	if !ok || len(data) == 0 {
+		return false
+	}
+	b := parseBackend(ep.Fallback, ep.GetTargetOr(DefaultSNIPort))
+	metered, buckets, ok := admitClient(ctx, conn, "", logger, ep)
+	if !ok {
+		return true
+	}
+	logger.Debug("routing to fallback",
+		zap.String("client", conn.RemoteAddr().String()),
+		zap.String("backend", b.String()),
+	)
+	go relayBuffered(ctx, metered, func() (net.Conn, error) { return b.dial(ctx, ep, logger) }, data, logger, ep, buckets)
+	return true
+}
+
 // PROXY HANDLER.
-func proxyToTarget(parentCtx context.Context, client net.Conn, sni string, buf []byte, n int, logger *zap.Logger, entry config.EntryPoint) {
-	ctx, cancel := context.WithTimeout(parentCtx, entry.GetTimeout())
+func proxyToTarget(ctx context.Context, client net.Conn, sni string, buf []byte, n int, logger *zap.Logger, entry config.EntryPoint, buckets []*utils.Bucket) {
+	port := entry.GetTargetOr(DefaultSNIPort)
+	dial, err := targetDialer(ctx, entry, sni, port, logger)
+	if err != nil {
+		_ = client.Close()
+		return
+	}
+	if i, ok := interceptorFor(entry, sni); ok {
+		interceptConn(ctx, i, client, buf[:n], sni, port, dial, logger, entry, buckets)
+		return
+	}
+	target := net.JoinHostPort(sni, port)
+	relayBuffered(ctx, client, func() (net.Conn, error) { return dial("tcp", target) }, buf[:n], logger, entry, buckets)
+}
+
+// relayBuffered connects to the server, replays the bytes already read from the client and relays the rest.
+func relayBuffered(parentCtx context.Context, client net.Conn, dial func() (net.Conn, error), data []byte, logger *zap.Logger, entry config.EntryPoint, buckets []*utils.Bucket) {
+	connCtx, done := trackConn(parentCtx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, entry.GetTimeout())
 	defer cancel()
 
 	go func() {
@@ -148,38 +264,96 @@ func proxyToTarget(parentCtx context.Context, client net.Conn, sni string, buf [
 		_ = client.Close()
 	}()
 
-	target := net.JoinHostPort(sni, entry.GetTargetOr(DefaultSNIPort))
-	server, err := dialTarget(entry.Proxy, target, logger)
+	server, err := dial()
 	if err != nil {
+		logger.Debug("failed to connect to target", zap.Error(err))
 		_ = client.Close()
 		return
 	}
 	defer server.Close()
 
-	if _, err := server.Write(buf[:n]); err != nil {
-		logger.Error("initial write failed", zap.Error(err))
-		_ = client.Close()
-		return
+	if len(data) != 0 {
+		if _, err := server.Write(data); err != nil {
+			logger.Error("initial write failed", zap.Error(err))
+			_ = client.Close()
+			return
+		}
 	}
 
-	relayTraffic(ctx, client, server, logger)
+	relayTraffic(ctx, client, server, logger, buckets...)
 }
 
-func readSNI(conn net.Conn, logger *zap.Logger) ([]byte, []byte, int, error) {
-	buf := make([]byte, 4096)
+// readHello reads the first TLS record of the client and parses its ClientHello. Hellos that do not parse,
+// such as ones spread over several records, are scanned for the server name only.
+func readHello(conn net.Conn, logger *zap.Logger) (*tls.ClientHello, []byte, int, error) {
+	buf := make([]byte, maxHelloRecord)
 	n, err := conn.Read(buf)
 	if err != nil {
 		logger.Error("client read failed", zap.Error(err))
 		return nil, nil, 0, err
 	}
+	// The record may arrive in several TCP segments, its header tells how much is still missing
+	if n >= helloRecordHeader && buf[0] == helloRecordHandshake {
+		end := min(helloRecordHeader+int(binary.BigEndian.Uint16(buf[3:5])), len(buf))
+		if n < end {
+			m, err := io.ReadFull(conn, buf[n:end])
+			n += m
+			if err != nil {
+				logger.Error("client read failed", zap.Error(err))
+				return nil, nil, 0, err
+			}
+		}
+	}
 
-	name := tls.ExtractSNI(buf[:n])
-	if name == nil {
+	hello := new(tls.ClientHello)
+	if err := hello.Unmarshal(buf[:n]); err != nil {
+		// Version stays zero, marking the hello as partial (no fingerprints)
+		hello = new(tls.ClientHello)
+		if name := tls.ExtractSNI(buf[:n]); name != nil {
+			hello.SNIHostNames[0] = name
+			hello.SNICount = 1
+		}
+	}
+	if hello.ServerName() == nil {
 		// Its common to happen
 		logger.Debug("SNI missing",
 			zap.String("client", conn.RemoteAddr().String()),
 		)
-		return nil, nil, 0, errSNIMissing
+		return nil, buf, n, errSNIMissing
+	}
+	return hello, buf, n, nil
+}
+
+// helloProtocols returns the ALPN protocols offered in the hello.
+func helloProtocols(hello *tls.ClientHello) []string {
+	protocols := make([]string, hello.ALPNCount)
+	for i := range protocols {
+		protocols[i] = string(hello.ALPNProtocols[i])
 	}
-	return name, buf, n, nil
+	return protocols
+}
+
+// helloFingerprints returns the JA3 hash and JA4 fingerprint of the hello, empty for partial hellos.
+func helloFingerprints(hello *tls.ClientHello) (string, string) {
+	if hello.Version == 0 {
+		return "", ""
+	}
+	var buf [tls.JA3Len + tls.JA4Len]byte
+	fp := hello.AppendJA4(hello.AppendJA3(buf[:0]))
+	return string(fp[:tls.JA3Len]), string(fp[tls.JA3Len:])
+}
+
+// acceptsHello reports whether the tag group member accepts the ClientHello.
+func acceptsHello(ep config.EntryPoint, hello *tls.ClientHello, sni string, alpn []string, ja3, ja4 string) bool {
+	if hello.Version == 0 && inspectsHello(ep) {
+		return false
+	}
+	return ep.Allowed(sni) && ep.AllowedALPN(alpn) && ep.AllowedFingerprint(ja3, ja4) && ep.AllowedECH(hello.ECH)
+}
+
+// inspectsHello reports whether ep has policies that need a fully parsed hello, partial hellos carry
+// no fingerprints, ALPN or ECH extension and must not slip past them.
+func inspectsHello(ep config.EntryPoint) bool {
+	return len(ep.AllowFingerprint) != 0 || len(ep.BlockFingerprint) != 0 || len(ep.ALPN) != 0 ||
+		ep.ECH == config.ECHBlock || ep.ECH == config.ECHOnly
 }
@@ -0,0 +1,91 @@
+package router
+
+import (
+	stdtls "crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/fmotalleb/go-tools/matcher"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/crypto/tls"
+)
+
+// clientHello returns the first record a TLS client sends, padded with ALPN protocols to about size bytes.
+func clientHello(t *testing.T, size int) []byte {
+	t.Helper()
+	var protos []string
+	for i := 0; i*200 < size; i++ {
+		protos = append(protos, strings.Repeat(string(rune('a'+i%26)), 200))
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = stdtls.Client(client, &stdtls.Config{ServerName: "example.com", NextProtos: protos}).Handshake()
+		_ = client.Close()
+	}()
+	header := make([]byte, helloRecordHeader)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func TestReadHelloSplitRecord(t *testing.T) {
+	record := clientHello(t, 6000)
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		// Delivered in segments, the first one ending inside the record
+		for rest := record; len(rest) != 0; {
+			k := min(1400, len(rest))
+			if _, err := client.Write(rest[:k]); err != nil {
+				return
+			}
+			rest = rest[k:]
+		}
+	}()
+
+	hello, _, n, err := readHello(server, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(record) || hello.Version == 0 {
+		t.Fatalf("got %d of %d bytes, parsed %t, want the whole hello parsed", n, len(record), hello.Version != 0)
+	}
+	if string(hello.ServerName()) != "example.com" {
+		t.Errorf("got SNI %q", hello.ServerName())
+	}
+	if ja3, ja4 := helloFingerprints(hello); ja3 == "" || ja4 == "" {
+		t.Error("expected fingerprints of the parsed hello")
+	}
+}
+
+func TestPartialHelloRejectedByPolicy(t *testing.T) {
+	partial := new(tls.ClientHello)
+	partial.SNIHostNames[0] = []byte("example.com")
+	partial.SNICount = 1
+
+	open := config.EntryPoint{}
+	if !acceptsHello(open, partial, "example.com", nil, "", "") {
+		t.Error("entries without hello policies should accept partial hellos")
+	}
+	blocking := config.EntryPoint{BlockFingerprint: []*matcher.Matcher{new(matcher.Matcher)}}
+	if acceptsHello(blocking, partial, "example.com", nil, "", "") {
+		t.Error("a partial hello slipped past block_fingerprint")
+	}
+	// ECH hellos are large, a partial one must not pass as a hello without ECH
+	if acceptsHello(config.EntryPoint{ECH: config.ECHBlock}, partial, "example.com", nil, "", "") {
+		t.Error("a partial hello slipped past ech = block")
+	}
+	if acceptsHello(config.EntryPoint{ALPN: []*matcher.Matcher{new(matcher.Matcher)}}, partial, "example.com", nil, "", "") {
+		t.Error("a partial hello slipped past the alpn allow list")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/utils"
 )
 
 func init() {
@@ -28,11 +29,12 @@ func tcpRouter(ctx context.Context, entry config.EntryPoint) (bool, error) {
 
 	addrPort := entry.Listen
 	tcpAddr := net.TCPAddrFromAddrPort(addrPort)
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
 		logger.Error("failed to listen", zap.String("addr", addrPort.String()), zap.Error(err))
 		return true, err
 	}
+	listener := limitListener(ctx, tcpListener, entry, logger)
 	defer listener.Close()
 
 	if entry.Target == "" {
@@ -66,12 +68,33 @@ func tcpRouter(ctx context.Context, entry config.EntryPoint) (bool, error) {
 			continue
 		}
 
-		go handleTCPConnection(ctx, logger, conn, entry)
+		scopes := rateScopes(entry, clientIP(conn.RemoteAddr()), "")
+		if !admitConn(scopes) {
+			logger.Warn("connection rate limit exceeded",
+				zap.String("client", conn.RemoteAddr().String()),
+			)
+			_ = conn.Close()
+			continue
+		}
+
+		metered, err := meterConn(ctx, conn, entry)
+		if err != nil {
+			logger.Warn("connection rejected",
+				zap.String("client", conn.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			_ = conn.Close()
+			continue
+		}
+
+		go handleTCPConnection(ctx, logger, metered, entry, bandwidthBuckets(scopes))
 	}
 }
 
-func handleTCPConnection(parentCtx context.Context, logger *zap.Logger, conn net.Conn, entry config.EntryPoint) {
-	ctx, cancel := context.WithTimeout(parentCtx, entry.GetTimeout())
+func handleTCPConnection(parentCtx context.Context, logger *zap.Logger, conn net.Conn, entry config.EntryPoint, buckets []*utils.Bucket) {
+	connCtx, done := trackConn(parentCtx)
+	defer done()
+	ctx, cancel := context.WithTimeout(connCtx, entry.GetTimeout())
 	defer cancel()
 
 	go func() {
@@ -85,5 +108,5 @@ func handleTCPConnection(parentCtx context.Context, logger *zap.Logger, conn net
 	}
 	defer targetConn.Close()
 
-	relayTraffic(ctx, conn, targetConn, logger)
+	relayTraffic(ctx, conn, targetConn, logger, buckets...)
 }
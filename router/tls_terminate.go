@@ -0,0 +1,321 @@
+package router
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/fmotalleb/go-tools/log"
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/crypto/certs"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var errNoBackend = errors.New("no backend for server name")
+
+type policyKey struct{}
+
+func init() {
+	registerHandler(tlsTerminateHandler)
+}
+
+// tlsTerminateHandler completes the TLS handshake with local certificates and forwards the plaintext
+// (or re-encrypted) stream to the backend mapped by routes, falling back to `to`.
+// With tls.http set, requests are reverse proxied instead, keyed by their Host header.
+func tlsTerminateHandler(ctx context.Context, entry config.EntryPoint) (bool, error) {
+	if entry.Routing != config.RouterTLSTerminate {
+		return false, nil
+	}
+
+	logger := log.FromContext(ctx).
+		Named("router.tls-terminate").
+		With(
+			zap.String("router", string(entry.Routing)),
+			zap.String("listen", entry.Listen.String()),
+		)
+
+	if entry.TLS == nil {
+		logger.Error("TLS terminating proxy requires certificates or a local ca")
+		return true, buildFieldMissing("tls-terminate", "tls")
+	}
+	if entry.Target == "" && len(entry.Routes) == 0 {
+		logger.Error("TLS terminating proxy requires a backend")
+		return true, buildFieldMissing("tls-terminate", "to")
+	}
+	tlsConfig, err := terminateTLSConfig(entry)
+	if err != nil {
+		logger.Error("failed to load certificates", zap.Error(err))
+		return true, err
+	}
+
+	if entry.TLS.HTTP {
+		return true, serveTerminatedHTTP(ctx, entry, tlsConfig, logger)
+	}
+	return true, serveTerminatedStream(ctx, entry, tlsConfig, logger)
+}
+
+// terminateTLSConfig loads the certificates of entry, names not covered by them are minted by the local ca
+// as long as allow_list/block_list accept them.
+func terminateTLSConfig(entry config.EntryPoint) (*tls.Config, error) {
+	pairs := make([][2]string, 0, len(entry.TLS.Certificates))
+	for _, c := range entry.TLS.Certificates {
+		if c != nil {
+			pairs = append(pairs, [2]string{c.Cert, c.Key})
+		}
+	}
+	certificates, err := certs.LoadPairs(pairs)
+	if err != nil {
+		return nil, fmt.Errorf("tls-terminate: %w", err)
+	}
+	var ca *certs.CA
+	if entry.TLS.CA != nil {
+		if ca, err = certs.LoadOrCreateCA(entry.TLS.CA.Cert, entry.TLS.CA.Key); err != nil {
+			return nil, fmt.Errorf("tls-terminate: %w", err)
+		}
+	}
+	if len(certificates) == 0 && ca == nil {
+		return nil, buildFieldMissing("tls-terminate", "tls.certificates")
+	}
+	store := certs.NewStore(certificates, ca, entry.Allowed)
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.GetCertificate,
+	}, nil
+}
+
+func serveTerminatedStream(ctx context.Context, entry config.EntryPoint, tlsConfig *tls.Config, logger *zap.Logger) error {
+	tcpListener, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(entry.Listen))
+	if err != nil {
+		logger.Error("failed to listen", zap.String("addr", entry.Listen.String()), zap.Error(err))
+		return err
+	}
+	listener := limitListener(ctx, tcpListener, entry, logger)
+	defer listener.Close()
+
+	logger.Info("TLS terminating proxy booted")
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("listener closed due to context cancellation")
+				return nil
+			}
+			logger.Error("failed to accept connection", zap.Error(err))
+			continue
+		}
+
+		if !entry.AllowedFrom(conn.RemoteAddr()) {
+			logger.Debug("connection rejected",
+				zap.String("client", conn.RemoteAddr().String()),
+			)
+			_ = conn.Close()
+			continue
+		}
+
+		go handleTerminatedConn(ctx, conn, entry, tlsConfig, logger)
+	}
+}
+
+func handleTerminatedConn(ctx context.Context, conn net.Conn, entry config.EntryPoint, tlsConfig *tls.Config, logger *zap.Logger) {
+	tlsConn := tls.Server(conn, tlsConfig)
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	err := tlsConn.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		logger.Debug("TLS handshake failed", zap.String("client", conn.RemoteAddr().String()), zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+
+	sni := tlsConn.ConnectionState().ServerName
+	l := logger.With(zap.String("sni", sni))
+	if !entry.Allowed(sni) {
+		l.Warn("SNI rejected")
+		_ = tlsConn.Close()
+		return
+	}
+	b, ok := terminatedBackend(entry, sni)
+	if !ok {
+		l.Warn("no backend for server name")
+		_ = tlsConn.Close()
+		return
+	}
+
+	metered, buckets, ok := admitClient(ctx, tlsConn, sni, l, entry)
+	if !ok {
+		return
+	}
+	dial := func() (net.Conn, error) {
+		return dialTerminatedBackend(ctx, entry, b, sni, l)
+	}
+	relayBuffered(ctx, metered, dial, nil, l, entry, buckets)
+}
+
+// terminatedBackend returns the backend of name from routes, or `to` when no route matches.
+func terminatedBackend(entry config.EntryPoint, name string) (backend, bool) {
+	if b, ok := routeBackend(entry, name, ""); ok {
+		return b, true
+	}
+	if entry.Target == "" {
+		return backend{}, false
+	}
+	return parseBackend(entry.Target, ""), true
+}
+
+// dialTerminatedBackend connects to the backend, re-encrypting the connection when configured.
+func dialTerminatedBackend(ctx context.Context, entry config.EntryPoint, b backend, serverName string, logger *zap.Logger) (net.Conn, error) {
+	conn, err := b.dial(ctx, entry, logger)
+	if err != nil || !entry.TLS.Reencrypt {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cmp.Or(serverName, hostOnly(b.address)),
+		InsecureSkipVerify: entry.TLS.SkipVerify, //nolint:gosec // opt-in for self-signed backends
+	})
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		_ = conn.Close()
+		logger.Debug("backend TLS handshake failed", zap.String("backend", b.String()), zap.Error(err))
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func serveTerminatedHTTP(ctx context.Context, entry config.EntryPoint, tlsConfig *tls.Config, logger *zap.Logger) error {
+	if err := setupErrorPages(entry); err != nil {
+		return err
+	}
+	scheme := "http"
+	if entry.TLS.Reencrypt {
+		scheme = "https"
+	}
+	transport := &http.Transport{
+		DialContext: func(dialCtx context.Context, _, addr string) (net.Conn, error) {
+			b, ok := terminatedBackend(entry, hostOnly(addr))
+			if !ok {
+				return nil, errNoBackend
+			}
+			return b.dial(dialCtx, entry, logger)
+		},
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: entry.TLS.SkipVerify, //nolint:gosec // opt-in for self-signed backends
+		},
+		ForceAttemptHTTP2: true,
+	}
+	reverse := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = scheme
+			r.Out.URL.Host = terminatedRequestHost(r.In)
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			if policy, ok := resp.Request.Context().Value(policyKey{}).(trafficPolicy); ok {
+				resp.Body = readCloser{policy.reader(resp.Request.Context(), resp.Body), resp.Body}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("backend request failed", zap.String("host", r.Host), zap.Error(err))
+			writeError(w, r, entry, upstreamError(err, false))
+		},
+	}
+
+	server := &http.Server{
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(_ net.Listener) context.Context { return connContext(ctx) },
+		Addr:              entry.Listen.String(),
+		Handler:           &terminatedHTTPHandler{ctx: ctx, logger: logger, entry: entry, proxy: reverse},
+		TLSConfig:         tlsConfig,
+	}
+	logger.Info("TLS terminating HTTP proxy booted")
+	if err := serveHTTP(ctx, server, entry, logger); err != nil {
+		logger.Error("HTTP server error", zap.Error(err))
+		return errors.Join(
+			errors.New("failed to start listener for tls-terminate proxy"),
+			err,
+		)
+	}
+	return nil
+}
+
+// terminatedRequestHost returns the host a terminated request is routed by, the Host header or the SNI.
+func terminatedRequestHost(r *http.Request) string {
+	host := hostOnly(r.Host)
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	return host
+}
+
+type terminatedHTTPHandler struct {
+	ctx    context.Context
+	logger *zap.Logger
+	entry  config.EntryPoint
+	proxy  http.Handler
+}
+
+func (h *terminatedHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := addrFromRemote(r.RemoteAddr)
+	if !h.entry.AllowedFrom(remoteAddr) {
+		h.logger.Debug("connection rejected", zap.String("client", r.RemoteAddr))
+		writeError(w, r, h.entry, blockedClient)
+		return
+	}
+	host := terminatedRequestHost(r)
+	if !h.entry.Allowed(host) {
+		h.logger.Warn("hostname rejected", zap.String("hostname", host))
+		writeError(w, r, h.entry, blockedHost)
+		return
+	}
+
+	scopes := rateScopes(h.entry, clientIP(remoteAddr), host)
+	if !admitConn(scopes) {
+		h.logger.Warn("request rate limit exceeded", zap.String("client", r.RemoteAddr))
+		writeError(w, r, h.entry, rateLimited)
+		return
+	}
+	meter, err := newMeter(h.ctx, h.entry, remoteAddr)
+	if err != nil {
+		h.logger.Warn("request rejected", zap.String("client", r.RemoteAddr), zap.Error(err))
+		writeError(w, r, h.entry, quotaExceeded)
+		return
+	}
+	policy := trafficPolicy{buckets: bandwidthBuckets(scopes), meter: meter}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = readCloser{policy.reader(r.Context(), r.Body), r.Body}
+	}
+
+	h.logger.Debug("HTTP request received",
+		zap.String("method", r.Method),
+		zap.String("host", host),
+		zap.String("remoteAddr", r.RemoteAddr),
+	)
+	h.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), policyKey{}, policy)))
+}
+
+// readCloser reads through a wrapped reader while closing the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
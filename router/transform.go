@@ -0,0 +1,107 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+// hopHeaders apply to a single connection and are never forwarded (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// compileRewrites validates the path expressions of the rewrite rules of entry.
+func compileRewrites(entry config.EntryPoint) error {
+	for _, rw := range entry.Rewrites {
+		if rw == nil {
+			continue
+		}
+		if err := rw.Compile(); err != nil {
+			return fmt.Errorf("%s: %w", entry.Routing, err)
+		}
+	}
+	return nil
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including the ones listed by Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// matchRewrites returns the rewrite rules of entry that apply to the client request.
+func matchRewrites(entry config.EntryPoint, r *http.Request) []*config.Rewrite {
+	var matched []*config.Rewrite
+	host := hostOnly(r.Host)
+	for _, rw := range entry.Rewrites {
+		if rw != nil && rw.Matches(host, r.URL.Path) {
+			matched = append(matched, rw)
+		}
+	}
+	return matched
+}
+
+// rewriteRequest applies the request side of rules to the upstream request out, in is the client request.
+func rewriteRequest(rules []*config.Rewrite, in, out *http.Request) {
+	for _, rw := range rules {
+		if rw.Forwarded {
+			setForwarded(out.Header, in)
+		}
+		rw.RequestHeaders.Apply(out.Header)
+		if path := rw.RewritePath(out.URL.Path); path != out.URL.Path {
+			out.URL.Path = path
+			out.URL.RawPath = ""
+		}
+	}
+}
+
+// rewriteResponse applies the response side of rules to the upstream response headers.
+func rewriteResponse(rules []*config.Rewrite, header http.Header) {
+	for _, rw := range rules {
+		rw.ResponseHeaders.Apply(header)
+	}
+}
+
+// setForwarded appends the client to X-Forwarded-For and Forwarded and sets the other forwarding headers.
+func setForwarded(h http.Header, in *http.Request) {
+	client := hostOnly(in.RemoteAddr)
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	forwardedFor := client
+	if prior := h.Values("X-Forwarded-For"); len(prior) != 0 {
+		forwardedFor = strings.Join(prior, ", ") + ", " + client
+	}
+	h.Set("X-Forwarded-For", forwardedFor)
+	h.Set("X-Real-IP", client)
+	h.Set("X-Forwarded-Host", in.Host)
+	h.Set("X-Forwarded-Proto", proto)
+
+	node := client
+	if strings.Contains(node, ":") {
+		// IPv6 nodes must be bracketed and quoted
+		node = `"[` + node + `]"`
+	}
+	h.Add("Forwarded", fmt.Sprintf(`for=%s;host=%q;proto=%s`, node, in.Host, proto))
+}
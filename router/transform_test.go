@@ -0,0 +1,80 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Session")
+	h.Set("X-Session", "abc")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	h.Set("Upgrade", "h2c")
+	h.Set("Accept", "*/*")
+
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Accept") != "*/*" {
+		t.Errorf("expected only Accept to remain, got %v", h)
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	strip := "/"
+	entry := config.EntryPoint{Rewrites: []*config.Rewrite{
+		{
+			Path:           "^/api/",
+			PathReplace:    &strip,
+			Forwarded:      true,
+			RequestHeaders: &config.HeaderOps{Set: map[string]string{"X-Env": "dev"}, Remove: []string{"Cookie"}},
+		},
+		{
+			Path:            "^/static/",
+			ResponseHeaders: &config.HeaderOps{Add: map[string]string{"Cache-Control": "max-age=60"}},
+		},
+	}}
+	if err := compileRewrites(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	in := httptest.NewRequest(http.MethodGet, "http://app.example/api/users", nil)
+	in.RemoteAddr = "[2001:db8::1]:4242"
+	out := in.Clone(in.Context())
+	out.Header.Set("Cookie", "a=b")
+	out.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	rules := matchRewrites(entry, in)
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 matching rule, got %d", len(rules))
+	}
+	rewriteRequest(rules, in, out)
+
+	if out.URL.Path != "/users" {
+		t.Errorf("path = %q, want /users", out.URL.Path)
+	}
+	want := map[string]string{
+		"X-Env":             "dev",
+		"Cookie":            "",
+		"X-Forwarded-For":   "198.51.100.7, 2001:db8::1",
+		"X-Real-Ip":         "2001:db8::1",
+		"X-Forwarded-Host":  "app.example",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         `for="[2001:db8::1]";host="app.example";proto=http`,
+	}
+	for k, v := range want {
+		if got := out.Header.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+
+	static := httptest.NewRequest(http.MethodGet, "http://app.example/static/app.js", nil)
+	header := http.Header{}
+	rewriteResponse(matchRewrites(entry, static), header)
+	if header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("response rewrite not applied, got %v", header)
+	}
+}
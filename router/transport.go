@@ -0,0 +1,113 @@
+package router
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+const (
+	defaultPoolMaxIdle        = 100
+	defaultPoolMaxIdlePerHost = 16
+	defaultPoolIdleTimeout    = 90 * time.Second
+)
+
+var errNoDialer = errors.New("no dialer in request context")
+
+// Upstream transports are shared by the requests of an entrypoint and proxy chain so connections are kept alive.
+// They are dropped on reset and rebuilt from the reloaded config on first use.
+var (
+	transportMu sync.Mutex
+	transports  = map[string]*http.Transport{}
+)
+
+type dialKey struct{}
+
+func init() {
+	registerReset(func() {
+		transportMu.Lock()
+		defer transportMu.Unlock()
+		for _, t := range transports {
+			t.CloseIdleConnections()
+		}
+		transports = make(map[string]*http.Transport)
+	})
+}
+
+// withDial attaches the dial function used if the pooled transport has no idle connection for the request.
+func withDial(ctx context.Context, dial func(network, address string) (net.Conn, error)) context.Context {
+	return context.WithValue(ctx, dialKey{}, dial)
+}
+
+// entryTransport returns the pooled transport of entry, connections are opened with the dial function of the request.
+// The dial function of a host must not change for the lifetime of the transport, as connections are pooled by address.
+func entryTransport(entry config.EntryPoint) *http.Transport {
+	return pooledTransport(entry, false)
+}
+
+// entryH2CTransport is the pooled transport of entry speaking HTTP/2 over cleartext (prior knowledge) to upstreams.
+func entryH2CTransport(entry config.EntryPoint) *http.Transport {
+	return pooledTransport(entry, true)
+}
+
+// dialConfigKey identifies the config deciding where connections of entry go: the proxy chain, routes and
+// destination policy. Entries of a tag group share listener and target, a shared pool would hand one entry
+// the connections another entry was allowed to open.
+func dialConfigKey(entry config.EntryPoint) string {
+	return fmt.Sprintf("%s|%p|%p|%p|%p|%t", entryKey(entry), entry.Proxy, entry.Routes, entry.AllowTo, entry.BlockTo, entry.AllowInternal)
+}
+
+// upstreamTransport returns the transport shared by the requests of entry to upstream, built by newTransport on
+// first use so connections, TLS sessions and HTTP/2 streams are reused.
+func upstreamTransport(entry config.EntryPoint, upstream string, newTransport func() *http.Transport) *http.Transport {
+	key := dialConfigKey(entry) + "|" + upstream
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := newTransport()
+	transports[key] = t
+	return t
+}
+
+func pooledTransport(entry config.EntryPoint, h2c bool) *http.Transport {
+	pool := config.Pool{}
+	if entry.Pool != nil {
+		pool = *entry.Pool
+	}
+	key := fmt.Sprintf("%s|%d|%d|%s|%t", dialConfigKey(entry), pool.MaxIdle, pool.MaxIdlePerHost, pool.IdleTimeout, h2c)
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dial, ok := ctx.Value(dialKey{}).(func(network, address string) (net.Conn, error))
+			if !ok {
+				return nil, errNoDialer
+			}
+			return dial(network, address)
+		},
+		MaxIdleConns:        cmp.Or(pool.MaxIdle, defaultPoolMaxIdle),
+		MaxIdleConnsPerHost: cmp.Or(pool.MaxIdlePerHost, defaultPoolMaxIdlePerHost),
+		IdleConnTimeout:     cmp.Or(pool.IdleTimeout, defaultPoolIdleTimeout),
+		DisableKeepAlives:   pool.MaxIdlePerHost < 0,
+	}
+	if h2c {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	transports[key] = t
+	return t
+}
@@ -0,0 +1,75 @@
+package router
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestEntryTransportReusesConnections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	var dials atomic.Int32
+	dial := func(network, _ string) (net.Conn, error) {
+		dials.Add(1)
+		return net.Dial(network, backend.Listener.Addr().String())
+	}
+	entry := config.EntryPoint{Listen: netip.MustParseAddrPort("127.0.0.1:8080")}
+
+	get := func(tr *http.Transport) {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example/", nil)
+		req.RequestURI = ""
+		resp, err := tr.RoundTrip(req.WithContext(withDial(req.Context(), dial)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	tr := entryTransport(entry)
+	if entryTransport(entry) != tr {
+		t.Fatal("expected the transport of an entrypoint to be shared")
+	}
+	get(tr)
+	get(tr)
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+
+	Reset()
+	if entryTransport(entry) == tr {
+		t.Error("expected reset to drop pooled transports")
+	}
+
+	entry.Pool = &config.Pool{MaxIdlePerHost: -1}
+	tr = entryTransport(entry)
+	get(tr)
+	get(tr)
+	if n := dials.Load(); n != 3 {
+		t.Errorf("expected keep-alive to be disabled, got %d dials in total", n)
+	}
+	Reset()
+}
+
+func TestEntryTransportPerDestinationPolicy(t *testing.T) {
+	defer Reset()
+	listen := netip.MustParseAddrPort("127.0.0.1:8080")
+	open := config.EntryPoint{Listen: listen, Tag: new(string)}
+	limited := config.EntryPoint{Listen: listen, Tag: new(string), AllowTo: []*config.AddrMatcher{{}}}
+	if entryTransport(open) == entryTransport(limited) {
+		t.Error("tag group entries with different allow_to must not share pooled connections")
+	}
+	if entryTransport(limited) != entryTransport(limited) {
+		t.Error("expected the transport of an entrypoint to be shared")
+	}
+}
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"net"
 
 	"github.com/fmotalleb/go-tools/log"
@@ -43,19 +45,28 @@ func udpRouter(ctx context.Context, entry config.EntryPoint) (bool, error) {
 
 	logger.Info("raw UDP proxy booted")
 
+	clientManager := connection.NewUDPClientManager(connContext(ctx), logger, entry)
+	defer clientManager.Cleanup()
+	// On shutdown the socket stays open for the clients already relayed, until they are gone or the drain deadline
+	connCtx, done := trackConn(ctx)
 	go func() {
+		defer done()
 		<-ctx.Done()
+		select {
+		case <-clientManager.Drain():
+		case <-connCtx.Done():
+		}
 		_ = conn.Close()
 	}()
-
-	clientManager := connection.NewUDPClientManager(ctx, logger, entry)
-	defer clientManager.Cleanup()
+	limiter := newConnLimiter(entry)
+	// Every client is served by this read loop, waiting for a slot here would stall all of them
+	limiter.queueTimeout = 0
 
 	buffer := make([]byte, 65507) // Max UDP payload size
 	for {
 		n, clientAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
-			if ctx.Err() != nil {
+			if errors.Is(err, net.ErrClosed) {
 				logger.Info("listener closed due to context cancellation")
 				return true, nil
 			}
@@ -70,6 +81,17 @@ func udpRouter(ctx context.Context, entry config.EntryPoint) (bool, error) {
 			continue
 		}
 
-		go clientManager.HandlePacket(clientAddr, buffer[:n], conn)
+		client := clientAddr.IP.String()
+		release, err := limiter.acquire(ctx, client)
+		if err != nil {
+			limiter.reject(logger, client, err)
+			continue
+		}
+		// The buffer is reused by the next read while the packet is forwarded
+		packet := bytes.Clone(buffer[:n])
+		go func() {
+			defer release()
+			clientManager.HandlePacket(clientAddr, packet, conn)
+		}()
 	}
 }
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+// startUDPRaw runs a udp-raw entrypoint relaying to an echo server until ctx is canceled.
+func startUDPRaw(ctx context.Context, t *testing.T) netip.AddrPort {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	// Reserve a port for the entrypoint
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := probe.LocalAddr().(*net.UDPAddr).AddrPort()
+	_ = probe.Close()
+
+	entry := config.EntryPoint{Routing: config.RouterUDPRaw, Listen: listen, Target: echo.LocalAddr().String()}
+	go func() { _, _ = udpRouter(ctx, entry) }()
+	return listen
+}
+
+// dialUDPRaw returns a client whose packets are relayed by the entrypoint at listen, the first packet may be
+// sent before the listener is up so it is retried.
+func dialUDPRaw(t *testing.T, listen netip.AddrPort) *net.UDPConn {
+	t.Helper()
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(listen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	buf := make([]byte, 1500)
+	for attempt := 0; ; attempt++ {
+		if attempt == 50 {
+			t.Fatal("udp-raw entrypoint did not come up")
+		}
+		_, _ = client.Write([]byte("ready"))
+		_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := client.Read(buf); err == nil && string(buf[:n]) == "ready" {
+			return client
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestUDPRawForwardsEachPacket(t *testing.T) {
+	client := dialUDPRaw(t, startUDPRaw(t.Context(), t))
+
+	const packets = 32
+	for i := range packets {
+		if _, err := client.Write([]byte("packet-" + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1500)
+	seen := make(map[string]bool)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seen) < packets {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("got %d distinct packets back: %v", len(seen), err)
+		}
+		if got := string(buf[:n]); got != "ready" {
+			if seen[got] {
+				t.Fatalf("packet %q forwarded twice, the read buffer was shared", got)
+			}
+			seen[got] = true
+		}
+	}
+}
+
+func TestUDPRawDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	ctx, wait := WithDrain(ctx, 300*time.Millisecond)
+	listen := startUDPRaw(ctx, t)
+	client := dialUDPRaw(t, listen)
+	cancel()
+
+	// Known clients are still relayed while draining, new ones are not
+	buf := make([]byte, 1500)
+	if _, err := client.Write([]byte("draining")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "draining" {
+		t.Fatalf("got %q, %v while draining", buf[:n], err)
+	}
+	late, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(listen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	_, _ = late.Write([]byte("late"))
+	_ = late.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := late.Read(buf); err == nil {
+		t.Error("a new client was relayed while draining")
+	}
+
+	start := time.Now()
+	wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s, expected the deadline to close the sessions", elapsed)
+	}
+}
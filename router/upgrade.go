@@ -0,0 +1,111 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/fmotalleb/junction/config"
+	"github.com/fmotalleb/junction/quota"
+)
+
+// isUpgradeRequest reports whether the client asks to switch protocols (WebSocket, h2c, ...).
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// keepUpgradeHeaders restores the upgrade headers dropped along with the other hop-by-hop headers.
+func keepUpgradeHeaders(dst, src http.Header) {
+	dst.Set("Connection", "Upgrade")
+	dst.Set("Upgrade", src.Get("Upgrade"))
+}
+
+// relayUpgrade sends the upgrade request out over upstream. Once upstream switches protocols the client
+// connection is hijacked and both directions are relayed, any other response is returned to the client as is.
+// An error is returned if upstream failed before anything was written to w.
+func relayUpgrade(ctx context.Context, w http.ResponseWriter, r, out *http.Request, upstream net.Conn, entry config.EntryPoint, logger *zap.Logger, policy trafficPolicy) error {
+	defer upstream.Close()
+	stop := context.AfterFunc(ctx, func() { _ = upstream.Close() })
+	defer stop()
+
+	if err := out.Write(upstream); err != nil {
+		logger.Debug("upgrade request failed", zap.String("url", out.URL.String()), zap.Error(err))
+		return err
+	}
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		logger.Debug("upgrade response failed", zap.String("url", out.URL.String()), zap.Error(err))
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		for k, v := range resp.Header {
+			for _, val := range v {
+				w.Header().Add(k, val)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, policy.reader(ctx, resp.Body))
+		return nil
+	}
+
+	client, buffered, ok := hijack(w, r, entry, logger)
+	if !ok {
+		return nil
+	}
+	client = quota.WrapConn(client, policy.meter)
+
+	// The switching response and anything upstream sent after it go first
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	_ = resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		head.Write(data)
+	}
+	if _, err := client.Write(head.Bytes()); err != nil {
+		_ = client.Close()
+		return nil
+	}
+	if len(buffered) != 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			_ = client.Close()
+			return nil
+		}
+	}
+	logger.Debug("protocol switched", zap.String("url", out.URL.String()), zap.String("upgrade", resp.Header.Get("Upgrade")))
+	relayTraffic(ctx, client, upstream, logger, policy.buckets...)
+	return nil
+}
+
+// hijack takes over the client connection, data the client already sent after the request is returned with it.
+func hijack(w http.ResponseWriter, r *http.Request, entry config.EntryPoint, logger *zap.Logger) (net.Conn, []byte, bool) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Error("Hijacking unsupported")
+		writeError(w, r, entry, internalError)
+		return nil, nil, false
+	}
+
+	clientConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Hijack failed", zap.Error(err))
+		writeError(w, r, entry, internalError)
+		return nil, nil, false
+	}
+	var buffered []byte
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ = rw.Reader.Peek(n)
+	}
+	return clientConn, buffered, true
+}
@@ -0,0 +1,101 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/fmotalleb/junction/config"
+)
+
+func TestRelayUpgrade(t *testing.T) {
+	// Echo backend speaking a trivial protocol after the switch
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) || r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello ")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := r.Clone(r.Context())
+		out.URL.Scheme, out.URL.Host, out.RequestURI = "http", backend.Listener.Addr().String(), ""
+		removeHopHeaders(out.Header)
+		if isUpgradeRequest(r) {
+			keepUpgradeHeaders(out.Header, r.Header)
+		}
+		upstream, err := net.Dial("tcp", backend.Listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := relayUpgrade(ctx, w, r, out, upstream, config.EntryPoint{}, zap.NewNop(), trafficPolicy{}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("plain request status = %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: app.example\r\nConnection: keep-alive, Upgrade\r\nUpgrade: echo\r\n\r\nping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	got := make([]byte, len("hello ping"))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello ping" {
+		t.Errorf("relayed %q, want %q", got, "hello ping")
+	}
+}
+
+func TestHijackUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, _, ok := hijack(w, r, config.EntryPoint{}, zap.NewNop()); ok {
+		t.Fatal("hijacked a recorder")
+	}
+	if w.Code != http.StatusInternalServerError || w.Header().Get(errorHeader) != codeInternal {
+		t.Errorf("got %d with %s %q", w.Code, errorHeader, w.Header().Get(errorHeader))
+	}
+}
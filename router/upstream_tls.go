@@ -0,0 +1,73 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLS configures the TLS client of http-to-https towards its backend.
+type upstreamTLS struct {
+	// PEM bundle trusted instead of the system roots
+	CA         string `mapstructure:"ca"`
+	SkipVerify bool   `mapstructure:"skip_verify"`
+	// Server name sent in SNI and verified, defaults to the target host
+	ServerName string `mapstructure:"server_name"`
+	// Client certificate and key (mTLS)
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// Minimum TLS version, 1.0 to 1.3 (default 1.2)
+	MinVersion string `mapstructure:"min_version"`
+	// ALPN protocols offered to the backend, listing h2 enables HTTP/2
+	ALPN []string `mapstructure:"alpn"`
+}
+
+// config builds the client TLS config, nil means Go's defaults.
+func (o upstreamTLS) config() (*tls.Config, error) {
+	if o.CA == "" && !o.SkipVerify && o.ServerName == "" && o.Cert == "" && o.Key == "" && o.MinVersion == "" && len(o.ALPN) == 0 {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.SkipVerify, //nolint:gosec // opt-in for lab backends
+		NextProtos:         o.ALPN,
+	}
+	if o.MinVersion != "" {
+		v, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls min_version %q, expected one of 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if o.CA != "" {
+		pem, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls ca %q", o.CA)
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		if o.Cert == "" || o.Key == "" {
+			return nil, errors.New("tls cert and key must be set together")
+		}
+		pair, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
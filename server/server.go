@@ -12,6 +12,7 @@ import (
 
 	"github.com/fmotalleb/junction/config"
 	"github.com/fmotalleb/junction/dns"
+	"github.com/fmotalleb/junction/quota"
 	"github.com/fmotalleb/junction/router"
 )
 
@@ -23,6 +24,24 @@ var ErrServerDiedBeforeContext = errors.New("context is not canceled but listene
 func Serve(ctx context.Context, c config.Config) error {
 	wg := new(sync.WaitGroup)
 	defer router.Reset()
+	for i := range c.EntryPoints {
+		if err := c.EntryPoints[i].BuildACL(); err != nil {
+			return err
+		}
+	}
+	router.ApplyRateLimits(c.EntryPoints)
+	if err := router.SetupInterception(ctx, c.EntryPoints); err != nil {
+		return err
+	}
+	if err := router.SetupCaches(ctx, c.EntryPoints); err != nil {
+		return err
+	}
+	if err := quota.Validate(c.EntryPoints); err != nil {
+		return err
+	}
+	if _, err := quota.Setup(ctx, c.Core.QuotaStore); err != nil {
+		return err
+	}
 	if c.Core.FakeDNS != nil {
 		wg.Go(
 			func() {
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket whose rate can be changed while it is in use.
+// A non-positive rate means unlimited.
+type Bucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	b := new(Bucket)
+	b.SetRate(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetRate changes the refill rate and capacity of the bucket, tokens already available are kept.
+// Clearing the rate keeps the previous capacity, it applies again if a rate is set later.
+func (b *Bucket) SetRate(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	if rate > 0 || b.burst == 0 {
+		b.burst = math.Max(float64(burst), 1)
+	}
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// Burst returns the capacity of the bucket, 0 when the bucket is unlimited.
+func (b *Bucket) Burst() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+// Allow takes a single token if available.
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait takes n tokens, blocking until they are refilled or ctx is canceled.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IdleSince reports whether the bucket was not used since t.
+func (b *Bucket) IdleSince(t time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastUsed.Before(t)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.lastUsed = now
+	if b.last.IsZero() {
+		b.last = now
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*Bucket
+}
+
+// LimitReader returns a reader that takes a token from every bucket for each byte read.
+func LimitReader(ctx context.Context, r io.Reader, buckets ...*Bucket) io.Reader {
+	if len(buckets) == 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, buckets: buckets}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Never read more than a single burst so a slow bucket is not overdrawn
+	for _, b := range l.buckets {
+		if burst := b.Burst(); burst > 0 && burst < len(p) {
+			p = p[:burst]
+		}
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		for _, b := range l.buckets {
+			if wErr := b.Wait(l.ctx, n); wErr != nil {
+				return n, wErr
+			}
+		}
+	}
+	return n, err
+}
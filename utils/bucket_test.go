@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// countingReader records the size of the buffers it is asked to fill.
+type countingReader struct {
+	r     *strings.Reader
+	sizes []int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return c.r.Read(p)
+}
+
+func TestLimitReaderRateCleared(t *testing.T) {
+	b := NewBucket(1<<20, 16)
+	src := &countingReader{r: strings.NewReader(strings.Repeat("x", 64))}
+	r := LimitReader(context.Background(), src, b)
+
+	buf := make([]byte, 32)
+	if n, _ := r.Read(buf); n != 16 {
+		t.Fatalf("read %d bytes, want a single burst of 16", n)
+	}
+
+	// The limit is removed by a reload while the reader is still in use
+	b.SetRate(0, 0)
+	var out bytes.Buffer
+	if _, err := out.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 48 {
+		t.Errorf("read %d bytes after the limit was removed, want 48", out.Len())
+	}
+	if size := src.sizes[1]; size <= 16 {
+		t.Errorf("reads are still cut to %d bytes after the limit was removed", size)
+	}
+
+	b.SetRate(1<<20, 0)
+	if burst := b.Burst(); burst != 1 {
+		t.Errorf("got burst %d, want at least 1 once limited again", burst)
+	}
+}
@@ -1,12 +1,14 @@
 package utils
 
 import (
+	"context"
 	"io"
 )
 
-func Copy(dst io.WriteCloser, src io.ReadCloser) error {
+// Copy copies src into dst, throttled by the given buckets, and closes both ends afterwards.
+func Copy(ctx context.Context, dst io.WriteCloser, src io.ReadCloser, buckets ...*Bucket) error {
 	defer dst.Close()
 	defer src.Close()
-	_, err := io.Copy(dst, src)
+	_, err := io.Copy(dst, LimitReader(ctx, src, buckets...))
 	return err
 }
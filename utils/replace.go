@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+)
+
+const replaceChunkSize = 32 * 1024
+
+// ReplaceReader replaces strings while streaming. Matches spanning two reads are found by holding back
+// the tail of the input that may still start one. Like strings.Replacer, matches are found left to right
+// without overlapping and patterns are tried in argument order.
+type ReplaceReader struct {
+	src      io.Reader
+	old, new [][]byte
+	first    [256]bool
+	limit    int64 // source bytes rewritten before the rest is passed through, zero or less is unlimited
+	read     int64
+	in, out  []byte
+	buf      []byte
+	err      error
+}
+
+// NewReplaceReader returns a reader replacing the old, new pairs of oldnew in src.
+// Once more than limit bytes are read from src the remaining input is passed through untouched.
+func NewReplaceReader(src io.Reader, limit int64, oldnew ...string) *ReplaceReader {
+	r := &ReplaceReader{src: src, limit: limit}
+	for i := 0; i+1 < len(oldnew); i += 2 {
+		if oldnew[i] == "" {
+			continue
+		}
+		r.old = append(r.old, []byte(oldnew[i]))
+		r.new = append(r.new, []byte(oldnew[i+1]))
+		r.first[oldnew[i][0]] = true
+	}
+	return r
+}
+
+func (r *ReplaceReader) Read(p []byte) (int, error) {
+	if len(r.old) == 0 {
+		return r.src.Read(p)
+	}
+	for len(r.out) == 0 {
+		if r.err != nil {
+			if len(r.in) == 0 {
+				return 0, r.err
+			}
+			r.process(true)
+			continue
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, replaceChunkSize)
+		}
+		n, err := r.src.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		r.read += int64(n)
+		r.err = err
+		r.process(err != nil)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	if len(r.out) == 0 {
+		r.out = r.out[:0:cap(r.out)]
+	}
+	return n, nil
+}
+
+// process moves the input that can no longer be part of a match to the output, final flushes everything.
+func (r *ReplaceReader) process(final bool) {
+	if r.limit > 0 && r.read > r.limit {
+		r.out = append(r.out, r.in...)
+		r.in = r.in[:0]
+		return
+	}
+	in := r.in
+	i, start := 0, 0
+scan:
+	for i < len(in) {
+		if !r.first[in[i]] {
+			i++
+			continue
+		}
+		for k, old := range r.old {
+			if bytes.HasPrefix(in[i:], old) {
+				r.out = append(r.out, in[start:i]...)
+				r.out = append(r.out, r.new[k]...)
+				i += len(old)
+				start = i
+				continue scan
+			}
+			if !final && len(in)-i < len(old) && bytes.HasPrefix(old, in[i:]) {
+				// May still match once more input arrives
+				break scan
+			}
+		}
+		i++
+	}
+	r.out = append(r.out, in[start:i]...)
+	r.in = append(r.in[:0], in[i:]...)
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReplaceReader(t *testing.T) {
+	oldnew := []string{"example.com", "127.0.0.1", "example", "sample", "ab", "x"}
+	inputs := []string{
+		"",
+		"no match here",
+		"https://example.com/path and example.org",
+		"aab abab example.co",
+		strings.Repeat("example.com/", 5000),
+	}
+	for _, in := range inputs {
+		want := strings.NewReplacer(oldnew...).Replace(in)
+		// One byte reads force every match across read boundaries
+		got, err := io.ReadAll(NewReplaceReader(iotest.OneByteReader(strings.NewReader(in)), 0, oldnew...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("replace %q:\n got %q\nwant %q", in, got, want)
+		}
+	}
+}
+
+func TestReplaceReaderLimit(t *testing.T) {
+	in := strings.Repeat("a", replaceChunkSize) + strings.Repeat("b", replaceChunkSize)
+	got, err := io.ReadAll(NewReplaceReader(strings.NewReader(in), replaceChunkSize, "a", "1", "b", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Repeat("1", replaceChunkSize) + strings.Repeat("b", replaceChunkSize)
+	if string(got) != want {
+		t.Error("expected input past the limit to be passed through")
+	}
+}
+
+func TestReplaceReaderDoesNotHoldCompleteInput(t *testing.T) {
+	r := NewReplaceReader(strings.NewReader("data: event\n\nexam"), 0, "example", "sample")
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	if err != nil || n == 0 {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	// Bytes that cannot start a match are released before the source ends, "exam" is held back
+	if string(buf[:n]) != "data: event\n\n" {
+		t.Errorf("got %q", buf[:n])
+	}
+}